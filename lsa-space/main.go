@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"eelf.ru/lsa"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -27,8 +28,11 @@ func writeContents(file string, stat *lsa.Stat, contents []byte) error {
 	}
 
 	if stat.IsDir() {
-		if err = os.Mkdir(file, 0777); err != nil {
-			return fmt.Errorf("cannot mkdir %s: %s lstat was:%v", file, err, lstat)
+		// a dir which is already there only gets its mode
+		if lstat == nil || !lstat.IsDir() {
+			if err = os.Mkdir(file, 0777); err != nil {
+				return fmt.Errorf("cannot mkdir %s: %s lstat was:%v", file, err, lstat)
+			}
 		}
 		if err = os.Chmod(file, stat.Mode()); err != nil {
 			return fmt.Errorf("cannot chmod dir %s: %s", file, err)
@@ -46,7 +50,7 @@ func writeContents(file string, stat *lsa.Stat, contents []byte) error {
 }
 
 func writeFile(file string, stat *lsa.Stat, contents []byte) error {
-	fp, err := ioutil.TempFile(".", "lsa")
+	fp, err := ioutil.TempFile(".", lsa.TempPrefix)
 	if err != nil {
 		return fmt.Errorf("failed to make temp file: %s", err)
 	}
@@ -59,12 +63,56 @@ func writeFile(file string, stat *lsa.Stat, contents []byte) error {
 	}
 
 	if err = finishFile(tmpName, file, stat); err != nil {
+		os.Remove(tmpName)
 		return err
 	}
 
 	return nil
 }
 
+// replaceFile is writeContents for a regular file without the lstat up front,
+// a dir in the way is looked for only when the rename fails
+func replaceFile(file string, stat *lsa.Stat, contents []byte) error {
+	err := writeFile(file, stat, contents)
+	if err == nil {
+		return nil
+	}
+	if fi, lerr := os.Lstat(file); lerr != nil || !fi.IsDir() {
+		return err
+	}
+	if err = os.RemoveAll(file); err != nil {
+		return fmt.Errorf("cannot remove %s: %s", file, err)
+	}
+	return writeFile(file, stat, contents)
+}
+
+// remove deletes a file with a single unlink, dirs are removed recursively
+func remove(path string) error {
+	if err := os.Remove(path); err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// applyBatch applies the writes and deletes of a batch in order
+func applyBatch(batch []*lsa.Revent) error {
+	for _, re := range batch {
+		path := filepath.Join(re.Dir, re.Name)
+		var err error
+		if re.Typ == lsa.TDelete {
+			err = remove(path)
+		} else if re.Stat.IsDir() || re.Stat.IsLink() {
+			err = writeContents(path, re.Stat, re.Content)
+		} else {
+			err = replaceFile(path, re.Stat, re.Content)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", re, err)
+		}
+	}
+	return nil
+}
+
 func finishFile(tmpName, file string, stat *lsa.Stat) error {
 	var err error
 	if err = os.Chmod(tmpName, stat.Mode()); err != nil {
@@ -81,6 +129,10 @@ func finishFile(tmpName, file string, stat *lsa.Stat) error {
 	return nil
 }
 
+var keepReleases = flag.Int("releases", 0, "sync into releases/next under the dir and make it a release the current symlink points to at every sync point, keeping this many releases")
+
+var relayTo = flag.String("relay", "", "json list of downstream [user@]host:dir specs to forward the stream to, as {\"spec\": ..., \"relay\": [...]} with downstreams of their own")
+
 func main() {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -109,91 +161,241 @@ func main() {
 	if err = os.Chdir(args[0]); err != nil {
 		log.Fatalln("could not chdir", args[0], err)
 	}
+	var rel *releases
+	if *keepReleases > 0 {
+		base, err := os.Getwd()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		rel = &releases{base: base, keep: *keepReleases}
+		if err = rel.open(); err != nil {
+			log.Fatalln("could not open releases", err)
+		}
+	}
+	// a transaction left by a killed lsa-space is rolled back
+	if err = os.RemoveAll(txDir); err != nil {
+		log.Fatalln("could not clean", txDir, err)
+	}
+	var fwd *relay
+	if *relayTo != "" {
+		var trees []lsa.Relay
+		if err = json.Unmarshal([]byte(*relayTo), &trees); err != nil {
+			log.Fatalln("bad -relay", err)
+		}
+		if fwd, err = newRelay(trees, *keepReleases); err != nil {
+			log.Fatalln(err)
+		}
+		fwd.start()
+	}
 
 	duration := 60 * time.Second
 	t := time.NewTimer(duration)
 	t.Reset(duration)
 
 	reCh := make(chan *lsa.Revent)
+	errCh := make(chan error, 1)
 	go func() {
 		b := bufio.NewReaderSize(os.Stdin, 2<<20)
 		for {
 			re, err := lsa.UnmarshalRevent(b)
 			if err != nil {
-				log.Fatalln(err)
+				errCh <- err
+				return
 			}
 			reCh <- re
 		}
 	}()
+	// open transaction, nil outside of one
+	var cur *tx
+	fatal := func(v ...interface{}) {
+		if cur != nil {
+			cur.rollback()
+		}
+		log.Fatalln(v...)
+	}
 	var re *lsa.Revent
 	bigFiles := make(map[string]*os.File)
 
-	pingReply := make([]byte, 1)
-	rEv := lsa.Revent{Typ:lsa.TPing}
+	pingReply := make([]byte, 0, 1)
+	rEv := lsa.Revent{Typ: lsa.TPing}
 	if err := rEv.Marshal(&pingReply); err != nil {
 		log.Fatalln(err)
 	}
+	readyReply := make([]byte, 0, 1)
+	rEv = lsa.Revent{Typ: lsa.TReady}
+	if err := rEv.Marshal(&readyReply); err != nil {
+		log.Fatalln(err)
+	}
+	prepareFrame := make([]byte, 0, 1)
+	rEv = lsa.Revent{Typ: lsa.TPrepare}
+	if err := rEv.Marshal(&prepareFrame); err != nil {
+		log.Fatalln(err)
+	}
+	// frames go downstream as they came
+	frame := make([]byte, 0, 8192)
 
 	for {
 		select {
 		case <-t.C:
-			log.Fatalln("no events for", duration)
+			fatal("no events for", duration)
+		case err := <-errCh:
+			fatal(err)
 		case re = <-reCh:
 			t.Reset(duration)
 		}
+		if fwd != nil && re.Typ != lsa.TPing && re.Typ != lsa.TPrepare {
+			frame = frame[:0]
+			if err := re.Marshal(&frame); err != nil {
+				fatal(err)
+			}
+			fwd.forward(frame)
+		}
 
 		if re.Typ == lsa.TPing {
-			wrote, err := os.Stdout.Write(pingReply)
-			if err != nil || wrote != len(pingReply) {
-				log.Fatalln(err)
+			if fwd != nil {
+				// pingReply is the ping itself
+				fwd.answer(pingReply, pingReply)
+			} else if wrote, err := os.Stdout.Write(pingReply); err != nil || wrote != len(pingReply) {
+				fatal(err)
+			}
+		} else if cur != nil && (re.Typ == lsa.TWrite || re.Typ == lsa.TDelete || re.Typ == lsa.TBatch) {
+			batch := re.Batch
+			if re.Typ != lsa.TBatch {
+				batch = []*lsa.Revent{re}
+			}
+			for _, re := range batch {
+				if err := cur.stage(re); err != nil {
+					fatal("stage failed", err)
+				}
+			}
+		} else if re.Typ == lsa.TBegin {
+			if cur != nil {
+				fatal("begin inside a transaction")
+			}
+			if cur, err = beginTx(); err != nil {
+				fatal(err)
+			}
+		} else if re.Typ == lsa.TRelease {
+			if rel == nil {
+				fatal("release without -releases")
+			}
+			if cur != nil || len(bigFiles) != 0 {
+				fatal("release with changes in flight")
+			}
+			name, err := rel.flip()
+			if err != nil {
+				fatal("release failed", err)
+			}
+			log.Println("released", name)
+		} else if re.Typ == lsa.TPrepare {
+			// staging fails loudly, so a transaction still open is staged
+			if cur == nil {
+				fatal("prepare without begin")
+			}
+			if fwd != nil {
+				fwd.answer(prepareFrame, readyReply)
+			} else if wrote, err := os.Stdout.Write(readyReply); err != nil || wrote != len(readyReply) {
+				fatal(err)
 			}
+		} else if re.Typ == lsa.TAbort {
+			if cur == nil {
+				fatal("abort without begin")
+			}
+			cur.rollback()
+			cur = nil
+		} else if re.Typ == lsa.TCommit {
+			if cur == nil {
+				fatal("commit without begin")
+			}
+			if err := cur.commit(); err != nil {
+				// the ground shows it as the space error
+				frame = frame[:0]
+				rEv := lsa.Revent{Typ: lsa.TError, Dir: args[0], Name: err.Error()}
+				if rEv.Marshal(&frame) == nil {
+					if fwd != nil {
+						fwd.report(frame)
+					} else {
+						os.Stdout.Write(frame)
+					}
+				}
+				fatal("commit failed", err)
+			}
+			cur = nil
 		} else if re.Typ == lsa.TWrite {
 			err := writeContents(filepath.Join(re.Dir, re.Name), re.Stat, re.Content)
 			if err != nil {
-				log.Fatalln("write failed", err)
+				fatal("write failed", err)
 			}
 		} else if re.Typ == lsa.TDelete {
 			err := os.RemoveAll(filepath.Join(re.Dir, re.Name))
 			if err != nil {
-				log.Fatalln("delete failed", err)
+				fatal("delete failed", err)
+			}
+		} else if re.Typ == lsa.TBatch {
+			if err := applyBatch(re.Batch); err != nil {
+				fatal("batch failed", err)
 			}
 		} else if re.Typ == lsa.TBig || re.Typ == lsa.TBigFinish {
 			path := filepath.Join(re.Dir, re.Name)
 			fp, ok := bigFiles[path]
 			if !ok {
 				if re.Typ == lsa.TBigFinish {
-					log.Fatalln("bigfinish no bigfile")
+					fatal("bigfinish no bigfile")
 				}
-				fp, err = ioutil.TempFile(".", "lsa")
+				fp, err = ioutil.TempFile(".", lsa.TempPrefix)
 				if err != nil {
-					log.Fatalln(err)
+					fatal(err)
 				}
 				bigFiles[path] = fp
 			}
 			wrote, err := fp.Write(re.Content)
 			if err != nil || wrote != len(re.Content) {
-				log.Fatalf("cannot write (wrote %d instead of %d): %s", wrote, len(re.Content), err)
+				fatal(fmt.Sprintf("cannot write (wrote %d instead of %d): %s", wrote, len(re.Content), err))
 			}
 			if re.Typ == lsa.TBigFinish {
 				delete(bigFiles, path)
 				tmpName := fp.Name()
+				fi, err := fp.Stat()
 				fp.Close()
-				if err = finishFile(tmpName, path, re.Stat); err != nil {
-					log.Fatalln(err)
+				if err == nil && fi.Size() != re.Stat.Size() {
+					err = fmt.Errorf("big file %s got %d bytes instead of %d", path, fi.Size(), re.Stat.Size())
+				}
+				if err != nil {
+					os.Remove(tmpName)
+					fatal(err)
+				}
+				if cur != nil {
+					// lands with the rest of the transaction
+					err = cur.stageBig(tmpName, path, re.Stat)
+				} else {
+					err = finishFile(tmpName, path, re.Stat)
+				}
+				if err != nil {
+					fatal(err)
 				}
 			}
 		} else if re.Typ == lsa.TBigCancel {
 			path := filepath.Join(re.Dir, re.Name)
 			fp, ok := bigFiles[path]
 			if !ok {
-				log.Fatalln("no bigfile", path)
+				fatal("no bigfile", path)
 			}
 			err := os.Remove(fp.Name())
 			if err != nil {
-				log.Fatalln("bigcancel remove failed", err)
+				fatal("bigcancel remove failed", err)
 			}
 			fp.Close()
 			delete(bigFiles, path)
 		}
+		if fwd != nil && cur == nil && len(bigFiles) == 0 && fwd.revive() {
+			// rsync took its time, the timer may have fired meanwhile
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(duration)
+		}
 	}
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"eelf.ru/lsa"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// sessions run the test binary as lsa-space
+	if os.Getenv("LSA_SPACE_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// session is lsa-space run on dir
+type session struct {
+	t     *testing.T
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	out   *bufio.Reader
+}
+
+func startSession(t *testing.T, args ...string) *session {
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(), "LSA_SPACE_MAIN=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return &session{t: t, cmd: cmd, stdin: stdin, out: bufio.NewReader(stdout)}
+}
+
+func (s *session) send(evs ...*lsa.Revent) {
+	for _, re := range evs {
+		buf := make([]byte, 0, 64)
+		if err := re.Marshal(&buf); err != nil {
+			s.t.Fatal(err)
+		}
+		if _, err := s.stdin.Write(buf); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+func (s *session) read() *lsa.Revent {
+	re, err := lsa.UnmarshalRevent(s.out)
+	if err != nil {
+		s.t.Fatal("no reply:", err)
+	}
+	return re
+}
+
+// sync returns once lsa-space has applied the frames sent so far
+func (s *session) sync() {
+	s.send(&lsa.Revent{Typ: lsa.TPing})
+	if re := s.read(); re.Typ != lsa.TPing {
+		s.t.Fatalf("got %s instead of a ping", re)
+	}
+}
+
+// close ends the session and returns how lsa-space exited
+func (s *session) close() error {
+	s.stdin.Close()
+	return s.cmd.Wait()
+}
+
+// kill ends the session the way a lost connection does
+func (s *session) kill() {
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lsa-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// fileWrite is the write of a regular file with content
+func fileWrite(t *testing.T, path, content string) *lsa.Revent {
+	src := filepath.Join(tempDir(t), "src")
+	defer os.RemoveAll(filepath.Dir(src))
+	if err := ioutil.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	return &lsa.Revent{Typ: lsa.TWrite, Dir: filepath.Clean(dir), Name: name, Stat: lsa.NewStat(fi), Content: []byte(content)}
+}
+
+// checkFile fails unless path under dir has content, "" meaning no file
+func checkFile(t *testing.T, dir, path, content string) {
+	got, err := ioutil.ReadFile(filepath.Join(dir, path))
+	if content == "" {
+		if !os.IsNotExist(err) {
+			t.Fatalf("%s is there: %q %v", path, got, err)
+		}
+		return
+	}
+	if err != nil || string(got) != content {
+		t.Fatalf("%s has %q %v instead of %q", path, got, err, content)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"eelf.ru/lsa"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	relayRetry    = 10 * time.Second
+	relayRetryMax = 5 * time.Minute
+)
+
+// relay forwards the stream it applies to downstream lsa-spaces, a ping or a
+// prepare is answered upstream once every downstream has answered it, so an
+// ack means the whole subtree has the changes
+type relay struct {
+	releases int
+	ds       []*downstream
+	// stdout, where the answers go
+	up io.Writer
+
+	// guards the downstream sessions, the replies and writes to stdout
+	mu sync.Mutex
+	// answers to send upstream in order, each waits for the downstreams it was forwarded to
+	replies []*reply
+}
+
+type reply struct {
+	frame   []byte
+	waiting int
+}
+
+type downstream struct {
+	lsa.Relay
+	target, dir string
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	up    bool
+	// replies waiting for this downstream, oldest first
+	owed    []*reply
+	retryAt time.Time
+	backoff time.Duration
+}
+
+func newRelay(trees []lsa.Relay, releases int) (*relay, error) {
+	r := &relay{releases: releases, up: os.Stdout}
+	for _, t := range trees {
+		i := strings.Index(t.Spec, ":")
+		if i < 1 || i == len(t.Spec)-1 {
+			return nil, fmt.Errorf("bad relay spec %q, [user@]host:dir needed", t.Spec)
+		}
+		r.ds = append(r.ds, &downstream{Relay: t, target: t.Spec[:i], dir: t.Spec[i+1:]})
+	}
+	return r, nil
+}
+
+// start syncs the downstreams with the tree and opens their sessions, ones
+// failing are retried by revive
+func (r *relay) start() {
+	var wg sync.WaitGroup
+	for _, d := range r.ds {
+		wg.Add(1)
+		go func(d *downstream) {
+			defer wg.Done()
+			r.connect(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// revive reconnects the downstreams which are down and due, it runs between
+// frames with nothing in flight so rsync gives them everything applied so far
+func (r *relay) revive() bool {
+	revived := false
+	now := time.Now()
+	for _, d := range r.ds {
+		r.mu.Lock()
+		due := !d.up && !now.Before(d.retryAt)
+		r.mu.Unlock()
+		if due {
+			r.connect(d)
+			revived = true
+		}
+	}
+	return revived
+}
+
+func (r *relay) connect(d *downstream) {
+	if err := r.rsync(d); err != nil {
+		r.fail(d, nil, err)
+		return
+	}
+	args := lsa.SSHOptions()
+	args = append(args, d.target, "lsa-space")
+	if r.releases > 0 {
+		args = append(args, fmt.Sprint("-releases=", r.releases))
+	}
+	if len(d.Relay.Relay) > 0 {
+		arg, err := lsa.RelayArg(d.Relay.Relay)
+		if err != nil {
+			r.fail(d, nil, err)
+			return
+		}
+		args = append(args, arg)
+	}
+	args = append(args, d.dir)
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		r.fail(d, nil, err)
+		return
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		r.fail(d, nil, err)
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		r.fail(d, nil, err)
+		return
+	}
+	r.attach(d, cmd, stdin)
+	log.Println("relaying to", d.Spec)
+
+	go r.read(d, cmd, stdout)
+}
+
+// attach makes the started session the one of the downstream, rsync has
+// brought it up to date with whatever it was asked to confirm
+func (r *relay) attach(d *downstream, cmd *exec.Cmd, stdin io.WriteCloser) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d.cmd, d.stdin, d.up = cmd, stdin, true
+	d.backoff = 0
+	for _, rp := range d.owed {
+		rp.waiting--
+	}
+	d.owed = nil
+	r.flush()
+}
+
+func (r *relay) rsync(d *downstream) error {
+	dir, args := lsa.RsyncArgs(d.dir, r.releases > 0)
+	args = append(args, "-az", "--delete", "./", d.target+":"+dir+"/")
+	output, err := exec.Command("rsync", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rsync err:%s %s", err, string(output))
+	}
+	return nil
+}
+
+// read takes the answers of a downstream session, errors of the ones further down go upstream as they are
+func (r *relay) read(d *downstream, cmd *exec.Cmd, stdout io.Reader) {
+	b := bufio.NewReader(stdout)
+	for {
+		re, err := lsa.UnmarshalRevent(b)
+		if err != nil {
+			r.fail(d, cmd, err)
+			cmd.Wait()
+			return
+		}
+		r.mu.Lock()
+		if re.Typ == lsa.TError {
+			buf := make([]byte, 0, 64)
+			if err = re.Marshal(&buf); err == nil {
+				r.write(buf)
+			}
+		} else if d.cmd == cmd && len(d.owed) > 0 {
+			d.owed[0].waiting--
+			d.owed = d.owed[1:]
+			r.flush()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// fail takes the downstream down and reports it upstream, cmd is the session
+// failed or nil when it did not start
+func (r *relay) fail(d *downstream, cmd *exec.Cmd, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cmd != nil && (cmd != d.cmd || !d.up) {
+		// a session already given up on
+		return
+	}
+	if d.up {
+		d.up = false
+		d.stdin.Close()
+		d.cmd.Process.Kill()
+	}
+	if d.backoff == 0 {
+		d.backoff = relayRetry
+	} else if d.backoff *= 2; d.backoff > relayRetryMax {
+		d.backoff = relayRetryMax
+	}
+	d.retryAt = time.Now().Add(d.backoff)
+	log.Println("relay to", d.Spec, "failed:", err, "retry in", d.backoff)
+
+	buf := make([]byte, 0, 64)
+	rEv := lsa.Revent{Typ: lsa.TError, Dir: d.Spec, Name: err.Error()}
+	if err = rEv.Marshal(&buf); err == nil {
+		r.write(buf)
+	}
+}
+
+// forward sends a frame to every downstream which is up
+func (r *relay) forward(frame []byte) {
+	for _, d := range r.ds {
+		r.mu.Lock()
+		cmd, stdin := d.cmd, d.stdin
+		up := d.up
+		r.mu.Unlock()
+		if !up {
+			continue
+		}
+		if wrote, err := stdin.Write(frame); err != nil || wrote != len(frame) {
+			r.fail(d, cmd, fmt.Errorf("write: %v", err))
+		}
+	}
+}
+
+// answer forwards the frame and sends the reply upstream once every downstream
+// has answered it, replies go in order so a downstream being down holds back
+// the later ones until it is revived
+func (r *relay) answer(frame, answer []byte) {
+	r.mu.Lock()
+	rp := &reply{frame: answer}
+	for _, d := range r.ds {
+		// one being down confirms it by the rsync of its revival
+		d.owed = append(d.owed, rp)
+		rp.waiting++
+	}
+	r.replies = append(r.replies, rp)
+	r.flush()
+	r.mu.Unlock()
+	r.forward(frame)
+}
+
+// flush writes the replies nothing is waiting for anymore, r.mu is held
+func (r *relay) flush() {
+	for len(r.replies) > 0 && r.replies[0].waiting == 0 {
+		r.write(r.replies[0].frame)
+		r.replies = r.replies[1:]
+	}
+}
+
+// report sends a frame upstream out of the order of the replies
+func (r *relay) report(frame []byte) {
+	r.mu.Lock()
+	r.write(frame)
+	r.mu.Unlock()
+}
+
+// write sends a frame upstream, r.mu is held
+func (r *relay) write(frame []byte) {
+	if wrote, err := r.up.Write(frame); err != nil || wrote != len(frame) {
+		log.Fatalln("upstream write failed", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"eelf.ru/lsa"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// upstream takes the frames a relay answers with
+type upstream chan []byte
+
+func (u upstream) Write(frame []byte) (int, error) {
+	u <- append([]byte(nil), frame...)
+	return len(frame), nil
+}
+
+func (u upstream) expect(t *testing.T, want string) {
+	select {
+	case frame := <-u:
+		if string(frame) != want {
+			t.Fatalf("got %q upstream instead of %q", frame, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %q upstream", want)
+	}
+}
+
+func (u upstream) none(t *testing.T) {
+	select {
+	case frame := <-u:
+		t.Fatalf("got %q upstream too early", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// fakeDownstream is a session of a downstream lsa-space the test answers for,
+// the process is only there to be killed when the session fails
+type fakeDownstream struct {
+	cmd     *exec.Cmd
+	replies *io.PipeWriter
+}
+
+func attachFake(t *testing.T, r *relay, d *downstream) *fakeDownstream {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// forwarded frames are not looked at
+	fwdR, fwdW := io.Pipe()
+	go io.Copy(ioutil.Discard, fwdR)
+	repliesR, repliesW := io.Pipe()
+	r.attach(d, cmd, fwdW)
+	go r.read(d, cmd, repliesR)
+	return &fakeDownstream{cmd: cmd, replies: repliesW}
+}
+
+func (f *fakeDownstream) reply(t *testing.T) {
+	buf := make([]byte, 0, 1)
+	rEv := lsa.Revent{Typ: lsa.TPing}
+	if err := rEv.Marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.replies.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// down ends the session the way a lost connection does
+func (f *fakeDownstream) down() {
+	f.replies.Close()
+}
+
+func TestRelayReplies(t *testing.T) {
+	up := make(upstream, 16)
+	r, err := newRelay([]lsa.Relay{{Spec: "a:/a"}, {Spec: "b:/b"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.up = up
+	a := attachFake(t, r, r.ds[0])
+	b := attachFake(t, r, r.ds[1])
+	defer a.down()
+	ping := []byte("ping")
+
+	// the answer waits for every downstream
+	r.answer(ping, []byte("one"))
+	a.reply(t)
+	up.none(t)
+	b.reply(t)
+	up.expect(t, "one")
+
+	// b is lost, its error goes up right away
+	b.down()
+	select {
+	case frame := <-up:
+		rEv, err := lsa.UnmarshalRevent(bytes.NewReader(frame))
+		if err != nil || rEv.Typ != lsa.TError || rEv.Dir != "b:/b" {
+			t.Fatalf("got %s %v instead of the error of b", rEv, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error of b upstream")
+	}
+	// answers owed by b are held, later ones wait for them
+	r.answer(ping, []byte("two"))
+	r.answer(ping, []byte("three"))
+	a.reply(t)
+	a.reply(t)
+	up.none(t)
+
+	// the rsync of b's revival confirms everything owed, in order
+	b = attachFake(t, r, r.ds[1])
+	defer b.down()
+	up.expect(t, "two")
+	up.expect(t, "three")
+
+	r.answer(ping, []byte("four"))
+	b.reply(t)
+	up.none(t)
+	a.reply(t)
+	up.expect(t, "four")
+}
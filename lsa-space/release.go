@@ -0,0 +1,169 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// releases keeps the tree in base/releases/<id> dirs, changes go to
+// releases/next which becomes a release and the target of the current symlink
+// on flip, going back is pointing current to an older release
+type releases struct {
+	base string
+	// releases kept, the current one included
+	keep int
+}
+
+const nextRelease = "next"
+
+func (r *releases) path(name string) string {
+	return filepath.Join(r.base, "releases", name)
+}
+
+// open prepares releases/next, the initial rsync may have made it already, and makes it the working dir
+func (r *releases) open() error {
+	if err := os.MkdirAll(r.path(""), 0777); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(r.path(lsa.RsyncRelease)); err == nil {
+		if err = os.RemoveAll(r.path(nextRelease)); err != nil {
+			return err
+		}
+		if err = os.Rename(r.path(lsa.RsyncRelease), r.path(nextRelease)); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := os.Lstat(r.path(nextRelease)); os.IsNotExist(err) {
+		if err = r.seed(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return os.Chdir(r.path(nextRelease))
+}
+
+// seed makes releases/next from the current release, files are hard links as
+// every write of lsa-space replaces a file and never changes it in place, rsync
+// goes to a fresh dir
+func (r *releases) seed() error {
+	tmp := r.path("." + nextRelease)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	cur, err := filepath.EvalSymlinks(filepath.Join(r.base, "current"))
+	if os.IsNotExist(err) {
+		return os.Mkdir(r.path(nextRelease), 0777)
+	} else if err != nil {
+		return err
+	}
+	if err = linkTree(cur, tmp); err != nil {
+		return fmt.Errorf("cannot seed from %s: %s", cur, err)
+	}
+	return os.Rename(tmp, r.path(nextRelease))
+}
+
+func linkTree(src, dst string) error {
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	// dirs get their mode once filled, a read-only one would refuse the links
+	var dirs []dirMode
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			if rel == txDir {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, dirMode{target, fi.Mode().Perm()})
+			return os.Mkdir(target, 0777)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		return os.Link(path, target)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flip turns releases/next into a release, points current to it and seeds the next one
+func (r *releases) flip() (string, error) {
+	id := time.Now().UTC().Format("20060102T150405")
+	name := id
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(r.path(name)); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", id, i)
+	}
+	if err := os.Rename(r.path(nextRelease), r.path(name)); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(r.base, ".current.lsa")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.Symlink(filepath.Join("releases", name), tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(r.base, "current")); err != nil {
+		return "", fmt.Errorf("cannot switch current: %s", err)
+	}
+	if err := r.prune(name); err != nil {
+		return "", err
+	}
+	if err := r.seed(); err != nil {
+		return "", err
+	}
+	return name, os.Chdir(r.path(nextRelease))
+}
+
+// prune removes the oldest releases but keep, current is never removed
+func (r *releases) prune(current string) error {
+	fis, err := ioutil.ReadDir(r.path(""))
+	if err != nil {
+		return err
+	}
+	var old []string
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() && name != current && name != nextRelease && name[0] != '.' {
+			old = append(old, name)
+		}
+	}
+	sort.Strings(old)
+	for len(old) > 0 && len(old) >= r.keep {
+		if err = os.RemoveAll(r.path(old[0])); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
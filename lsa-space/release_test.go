@@ -0,0 +1,112 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// inDir runs f in a temp dir, releases chdir into releases/next
+func inDir(t *testing.T, f func(base string)) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := tempDir(t)
+	defer os.RemoveAll(base)
+	defer os.Chdir(wd)
+	f(base)
+}
+
+func TestReleasesFlip(t *testing.T) {
+	inDir(t, func(base string) {
+		r := &releases{base: base, keep: 2}
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		// lsa-space replaces files, it never writes into one in place
+		write := func(content string) {
+			if err := ioutil.WriteFile(".tmp", []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(".tmp", "f"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flip := func(want string) string {
+			name, err := r.flip()
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, err := os.Readlink(filepath.Join(base, "current"))
+			if err != nil || link != filepath.Join("releases", name) {
+				t.Fatalf("current points to %q %v instead of %s", link, err, name)
+			}
+			checkFile(t, base, "current/f", want)
+			// the next release starts as the current one
+			checkFile(t, base, "releases/next/f", want)
+			return name
+		}
+
+		write("one")
+		first := flip("one")
+		cur, _ := os.Stat(filepath.Join(base, "current/f"))
+		next, _ := os.Stat(filepath.Join(base, "releases/next/f"))
+		if !os.SameFile(cur, next) {
+			t.Fatal("next is not linked to the current release")
+		}
+		write("two")
+		checkFile(t, base, "current/f", "one")
+		second := flip("two")
+		if second == first {
+			t.Fatalf("%s released twice", first)
+		}
+		write("three")
+		third := flip("three")
+
+		// keep counts the current release
+		fis, err := ioutil.ReadDir(r.path(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		want := []string{second, third, nextRelease}
+		sort.Strings(want)
+		if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] || names[2] != want[2] {
+			t.Fatalf("releases %v, want %v", names, want)
+		}
+	})
+}
+
+func TestReleasesOpenRsync(t *testing.T) {
+	inDir(t, func(base string) {
+		r := &releases{base: base, keep: 2}
+		for _, path := range []string{lsa.RsyncRelease + "/f", nextRelease + "/stale"} {
+			path = r.path(path)
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte("f"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the initial rsync went to releases/.rsync, it replaces a next left over
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		checkFile(t, base, "releases/next/f", "f")
+		checkFile(t, base, "releases/next/stale", "")
+		if _, err := os.Lstat(r.path(lsa.RsyncRelease)); !os.IsNotExist(err) {
+			t.Fatalf("%s left: %v", lsa.RsyncRelease, err)
+		}
+		if wd, _ := os.Getwd(); wd != r.path(nextRelease) {
+			t.Fatalf("working in %s", wd)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// txDir holds the staged files of the open transaction, it is inside the
+// target dir so the commit is a series of renames
+const txDir = lsa.TempPrefix + "-tx"
+
+type txOp struct {
+	path string
+	// nil for deletes
+	stat *lsa.Stat
+	// staged file or symlink, empty for deletes and dirs
+	tmp string
+}
+
+// tx stages writes and deletes until the commit
+type tx struct {
+	ops []txOp
+}
+
+func beginTx() (*tx, error) {
+	if err := os.RemoveAll(txDir); err != nil {
+		return nil, fmt.Errorf("cannot clean %s: %s", txDir, err)
+	}
+	if err := os.Mkdir(txDir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot mkdir %s: %s", txDir, err)
+	}
+	return &tx{}, nil
+}
+
+func (t *tx) stage(re *lsa.Revent) error {
+	op := txOp{path: filepath.Join(re.Dir, re.Name)}
+	if re.Typ == lsa.TWrite {
+		op.stat = re.Stat
+		if !re.Stat.IsDir() {
+			op.tmp = filepath.Join(txDir, strconv.Itoa(len(t.ops)))
+			if err := writeContents(op.tmp, re.Stat, re.Content); err != nil {
+				return err
+			}
+		}
+	}
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+// stageBig takes a finished big file into the transaction
+func (t *tx) stageBig(tmpName, path string, stat *lsa.Stat) error {
+	op := txOp{path: path, stat: stat, tmp: filepath.Join(txDir, strconv.Itoa(len(t.ops)))}
+	if err := finishFile(tmpName, op.tmp, stat); err != nil {
+		return err
+	}
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+// commit applies the staged changes in the order they came, a failure midway
+// leaves the ones before it applied: it ends the session and the ground syncs
+// the whole tree with rsync before the next one
+func (t *tx) commit() error {
+	for _, op := range t.ops {
+		var err error
+		if op.stat == nil {
+			err = remove(op.path)
+		} else if op.tmp == "" {
+			err = writeContents(op.path, op.stat, nil)
+		} else {
+			err = moveInto(op.tmp, op.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(txDir)
+}
+
+// rollback drops the staged changes, nothing of them is visible yet
+func (t *tx) rollback() {
+	if err := os.RemoveAll(txDir); err != nil {
+		log.Println("rollback failed", err)
+	}
+}
+
+// moveInto renames a staged file over path, a dir in the way is removed first
+func moveInto(tmp, path string) error {
+	err := os.Rename(tmp, path)
+	if err == nil {
+		return nil
+	}
+	if fi, lerr := os.Lstat(path); lerr != nil || !fi.IsDir() {
+		return fmt.Errorf("cannot rename %s to %s: %s", tmp, path, err)
+	}
+	if err = os.RemoveAll(path); err != nil {
+		return fmt.Errorf("cannot remove %s: %s", path, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("cannot rename %s to %s: %s", tmp, path, err)
+	}
+	return nil
+}
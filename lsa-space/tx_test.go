@@ -0,0 +1,110 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTxCommit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := startSession(t, dir)
+	defer s.kill()
+
+	s.send(&lsa.Revent{Typ: lsa.TBegin},
+		fileWrite(t, "a", "a"),
+		&lsa.Revent{Typ: lsa.TWrite, Dir: ".", Name: "d", Stat: lsa.NewDirStat()},
+		fileWrite(t, "d/b", "b"),
+		&lsa.Revent{Typ: lsa.TDelete, Dir: ".", Name: "old"})
+	s.sync()
+	// staged, nothing is visible yet
+	checkFile(t, dir, "a", "")
+	checkFile(t, dir, "d/b", "")
+	checkFile(t, dir, "old", "old")
+
+	s.send(&lsa.Revent{Typ: lsa.TCommit})
+	s.sync()
+	checkFile(t, dir, "a", "a")
+	checkFile(t, dir, "d/b", "b")
+	checkFile(t, dir, "old", "")
+	if _, err := os.Lstat(filepath.Join(dir, txDir)); !os.IsNotExist(err) {
+		t.Fatalf("%s left after the commit: %v", txDir, err)
+	}
+}
+
+func TestTxAbort(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := startSession(t, dir)
+	defer s.kill()
+
+	s.send(&lsa.Revent{Typ: lsa.TBegin},
+		fileWrite(t, "a", "a"),
+		&lsa.Revent{Typ: lsa.TDelete, Dir: ".", Name: "old"},
+		&lsa.Revent{Typ: lsa.TAbort})
+	s.sync()
+	checkFile(t, dir, "a", "")
+	checkFile(t, dir, "old", "old")
+
+	// writes after the abort land right away
+	s.send(fileWrite(t, "c", "c"))
+	s.sync()
+	checkFile(t, dir, "c", "c")
+	if _, err := os.Lstat(filepath.Join(dir, txDir)); !os.IsNotExist(err) {
+		t.Fatalf("%s left after the abort: %v", txDir, err)
+	}
+}
+
+func TestTxRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := startSession(t, dir)
+	s.send(&lsa.Revent{Typ: lsa.TBegin}, fileWrite(t, "a", "a"))
+	s.sync()
+	// the connection is lost with the transaction open
+	s.kill()
+	if _, err := os.Lstat(filepath.Join(dir, txDir)); err != nil {
+		t.Fatalf("nothing staged: %v", err)
+	}
+
+	s = startSession(t, dir)
+	defer s.kill()
+	s.sync()
+	checkFile(t, dir, "a", "")
+	if _, err := os.Lstat(filepath.Join(dir, txDir)); !os.IsNotExist(err) {
+		t.Fatalf("%s left by the killed session: %v", txDir, err)
+	}
+}
+
+func TestTxCommitFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := startSession(t, dir)
+	defer s.kill()
+
+	// the parent of b is not there, its rename fails
+	s.send(&lsa.Revent{Typ: lsa.TBegin},
+		fileWrite(t, "a", "a"),
+		fileWrite(t, "missing/b", "b"),
+		&lsa.Revent{Typ: lsa.TCommit})
+	re := s.read()
+	if re.Typ != lsa.TError || re.Dir != dir || !strings.Contains(re.Name, "missing/b") {
+		t.Fatalf("got %s instead of the commit error", re)
+	}
+	if err := s.close(); err == nil {
+		t.Fatal("the session goes on after a failed commit")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, txDir)); !os.IsNotExist(err) {
+		t.Fatalf("%s left after a failed commit: %v", txDir, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// barrier lets the spaces of a project commit a diff round together: every
+// space stages the round and votes, the round commits once all of them are
+// ready and aborts when one leaves or the timeout passes first
+type barrier struct {
+	mu sync.Mutex
+	// space name to the seq after which it takes part in rounds
+	members map[string]uint64
+	// open rounds by the seq of their last event
+	rounds map[uint64]*barrierRound
+
+	commits, aborts uint64
+}
+
+type barrierRound struct {
+	ready  map[string]bool
+	done   chan struct{}
+	commit bool
+}
+
+func newBarrier() *barrier {
+	return &barrier{members: make(map[string]uint64), rounds: make(map[uint64]*barrierRound)}
+}
+
+// join makes the space take part in rounds ending after seq, earlier ones
+// were synced by other means and are not waited for, join again to move past
+func (b *barrier) join(name string, seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.members[name] = seq
+	for rseq, r := range b.rounds {
+		b.check(rseq, r)
+	}
+}
+
+// leave aborts the rounds the space did not vote for
+func (b *barrier) leave(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	from, ok := b.members[name]
+	if !ok {
+		return
+	}
+	delete(b.members, name)
+	for rseq, r := range b.rounds {
+		if rseq > from && !r.ready[name] {
+			b.decide(rseq, r, false)
+		}
+	}
+}
+
+// vote tells that the space has staged the round ending at seq and waits for
+// all the others, true means commit
+func (b *barrier) vote(ctx context.Context, name string, seq uint64, timeout time.Duration) (bool, error) {
+	b.mu.Lock()
+	r, ok := b.rounds[seq]
+	if !ok {
+		r = &barrierRound{ready: make(map[string]bool), done: make(chan struct{})}
+		b.rounds[seq] = r
+	}
+	r.ready[name] = true
+	b.check(seq, r)
+	b.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-r.done:
+	case <-t.C:
+		b.mu.Lock()
+		b.decide(seq, r, false)
+		b.mu.Unlock()
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	return r.commit, nil
+}
+
+// check commits the round when every member taking part is ready
+func (b *barrier) check(seq uint64, r *barrierRound) {
+	for name, from := range b.members {
+		if seq > from && !r.ready[name] {
+			return
+		}
+	}
+	b.decide(seq, r, true)
+}
+
+func (b *barrier) decide(seq uint64, r *barrierRound, commit bool) {
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	r.commit = commit
+	close(r.done)
+	delete(b.rounds, seq)
+	if commit {
+		b.commits++
+	} else {
+		b.aborts++
+	}
+}
+
+func (b *barrier) stats() (commits, aborts uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.commits, b.aborts
+}
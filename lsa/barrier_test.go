@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBarrier(t *testing.T) {
+	b := newBarrier()
+	b.join("a", 10)
+	b.join("b", 10)
+	// c joined later, rounds up to 20 do not wait for it
+	b.join("c", 20)
+	ctx := context.Background()
+
+	res := make(chan bool, 2)
+	go func() {
+		ok, _ := b.vote(ctx, "a", 15, time.Minute)
+		res <- ok
+	}()
+	ok, err := b.vote(ctx, "b", 15, time.Minute)
+	if err != nil || !ok || !<-res {
+		t.Fatal("round 15 not committed", ok, err)
+	}
+
+	// b fails to stage round 25, none commits
+	go func() {
+		ok, _ := b.vote(ctx, "a", 25, time.Minute)
+		res <- ok
+	}()
+	go func() {
+		ok, _ := b.vote(ctx, "c", 25, time.Minute)
+		res <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.leave("b")
+	if <-res || <-res {
+		t.Fatal("round 25 committed without b")
+	}
+
+	// nobody else votes in time
+	if ok, _ = b.vote(ctx, "a", 30, 10*time.Millisecond); ok {
+		t.Fatal("round 30 committed without c")
+	}
+	// c moved past round 35 by a resync
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.join("c", 40)
+	}()
+	if ok, _ = b.vote(ctx, "a", 35, time.Minute); !ok {
+		t.Fatal("round 35 not committed")
+	}
+	if commits, aborts := b.stats(); commits != 2 || aborts != 2 {
+		t.Fatal("stats", commits, aborts)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type pendingDir struct {
+	first, last time.Time
+	order       int
+	// changed entries, nil when the whole dir has to be read
+	names map[string]bool
+}
+
+// dirBatch collects dirs reported by the watcher, every dir waits for its own
+// quiet period but not longer than maxDelay since its first change
+type dirBatch struct {
+	dirs     map[string]*pendingDir
+	order    int
+	debounce time.Duration
+	maxDelay time.Duration
+}
+
+func newDirBatch(debounce, maxDelay time.Duration) *dirBatch {
+	return &dirBatch{dirs: make(map[string]*pendingDir), debounce: debounce, maxDelay: maxDelay}
+}
+
+// add marks the whole dir changed
+func (b *dirBatch) add(dir string, now time.Time) {
+	b.pending(dir, now).names = nil
+}
+
+// addEntry marks a single entry of dir changed
+func (b *dirBatch) addEntry(dir, name string, now time.Time) {
+	d, ok := b.dirs[dir]
+	if !ok {
+		d = b.pending(dir, now)
+		d.names = make(map[string]bool)
+	}
+	d.last = now
+	if d.names != nil {
+		d.names[name] = true
+	}
+}
+
+func (b *dirBatch) pending(dir string, now time.Time) *pendingDir {
+	if d, ok := b.dirs[dir]; ok {
+		d.last = now
+		return d
+	}
+	d := &pendingDir{first: now, last: now, order: b.order}
+	b.dirs[dir] = d
+	b.order++
+	return d
+}
+
+func (b *dirBatch) due(d *pendingDir) time.Time {
+	quiet := d.last.Add(b.debounce)
+	if deadline := d.first.Add(b.maxDelay); deadline.Before(quiet) {
+		return deadline
+	}
+	return quiet
+}
+
+// next returns the earliest time some dir is due, zero time if the batch is empty
+func (b *dirBatch) next() (next time.Time) {
+	for _, d := range b.dirs {
+		if due := b.due(d); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return
+}
+
+type takenDir struct {
+	dir string
+	// sorted changed entries, nil for the whole dir
+	names  []string
+	waited time.Duration
+}
+
+// take removes dirs due at now (all of them if all is set) in the order they appeared
+func (b *dirBatch) take(now time.Time, all bool) []takenDir {
+	var taken []takenDir
+	var orders []int
+	for dir, d := range b.dirs {
+		if all || !b.due(d).After(now) {
+			var names []string
+			if d.names != nil {
+				names = make([]string, 0, len(d.names))
+				for name := range d.names {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+			}
+			taken = append(taken, takenDir{dir, names, now.Sub(d.first)})
+			orders = append(orders, d.order)
+			delete(b.dirs, dir)
+		}
+	}
+	sort.Sort(byOrder{taken, orders})
+	if len(b.dirs) == 0 {
+		b.order = 0
+	}
+	return taken
+}
+
+type byOrder struct {
+	dirs   []takenDir
+	orders []int
+}
+
+func (s byOrder) Len() int           { return len(s.dirs) }
+func (s byOrder) Less(i, j int) bool { return s.orders[i] < s.orders[j] }
+func (s byOrder) Swap(i, j int) {
+	s.dirs[i], s.dirs[j] = s.dirs[j], s.dirs[i]
+	s.orders[i], s.orders[j] = s.orders[j], s.orders[i]
+}
+
+// storm tracks an event storm: per-file events are dropped and the subtree
+// under dir is synced in bulk once no changes come for a while
+type storm struct {
+	since, last time.Time
+	// common ancestor of the changed dirs, empty until the first change
+	dir     string
+	changes int
+}
+
+func (s *storm) touch(dir string, now time.Time) {
+	s.last = now
+	if s.dir == "" {
+		s.dir = dir
+	} else {
+		s.dir = commonDir(s.dir, dir)
+	}
+}
+
+// commonDir returns the deepest dir containing both a and b, "." is the root
+func commonDir(a, b string) string {
+	for a != b {
+		if len(a) < len(b) {
+			a, b = b, a
+		}
+		if a == "." || b == "." {
+			return "."
+		}
+		if strings.HasPrefix(a, b+"/") {
+			return b
+		}
+		a = path.Dir(a)
+	}
+	return a
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDirBatchChurn(t *testing.T) {
+	b := newDirBatch(400*time.Millisecond, 2*time.Second)
+	start := time.Unix(1000, 0)
+
+	// a log writer touches "logs" every 100ms, "src" is saved once
+	b.add("logs", start)
+	b.add("src", start.Add(50*time.Millisecond))
+	var srcAt, logsAt time.Time
+	for now := start; now.Before(start.Add(5 * time.Second)); now = now.Add(10 * time.Millisecond) {
+		if now.Sub(start)%(100*time.Millisecond) == 0 {
+			b.add("logs", now)
+		}
+		for _, d := range b.take(now, false) {
+			if d.dir == "src" && srcAt.IsZero() {
+				srcAt = now
+			}
+			if d.dir == "logs" && logsAt.IsZero() {
+				logsAt = now
+				if d.waited != 2*time.Second {
+					t.Fatalf("logs waited %v", d.waited)
+				}
+			}
+		}
+	}
+	if want := start.Add(450 * time.Millisecond); !srcAt.Equal(want) {
+		t.Fatalf("src diffed at %v want %v", srcAt.Sub(start), want.Sub(start))
+	}
+	if want := start.Add(2 * time.Second); !logsAt.Equal(want) {
+		t.Fatalf("logs diffed at %v want %v", logsAt.Sub(start), want.Sub(start))
+	}
+}
+
+func TestDirBatchOrder(t *testing.T) {
+	b := newDirBatch(400*time.Millisecond, 2*time.Second)
+	now := time.Unix(1000, 0)
+	for _, dir := range []string{"c", "a", "b", "a"} {
+		b.add(dir, now)
+	}
+	if next := b.next(); !next.Equal(now.Add(400 * time.Millisecond)) {
+		t.Fatalf("next %v", next)
+	}
+	if taken := b.take(now, false); len(taken) != 0 {
+		t.Fatalf("taken before due %v", taken)
+	}
+	taken := b.take(now, true)
+	if len(taken) != 3 || taken[0].dir != "c" || taken[1].dir != "a" || taken[2].dir != "b" {
+		t.Fatalf("order %v", taken)
+	}
+	if !b.next().IsZero() {
+		t.Fatal("batch is not empty")
+	}
+}
+
+func TestCommonDir(t *testing.T) {
+	for _, c := range [][3]string{
+		{"a/b", "a/c", "a"},
+		{"a/b/c", "a/b", "a/b"},
+		{"a", "b", "."},
+		{"ab", "a", "."},
+		{".", "a/b", "."},
+		{"a/b", "a/b", "a/b"},
+	} {
+		if d := commonDir(c[0], c[1]); d != c[2] {
+			t.Errorf("commonDir(%q, %q) = %q want %q", c[0], c[1], d, c[2])
+		}
+	}
+}
+
+func TestDirBatchEntries(t *testing.T) {
+	b := newDirBatch(400*time.Millisecond, 2*time.Second)
+	now := time.Unix(1000, 0)
+	b.addEntry("assets", "b.js", now)
+	b.addEntry("assets", "a.js", now)
+	b.addEntry("src", "main.go", now)
+	// a dir-level event makes the whole dir read
+	b.add("src", now)
+	b.addEntry("src", "other.go", now)
+
+	taken := b.take(now, true)
+	if len(taken) != 2 {
+		t.Fatalf("taken %v", taken)
+	}
+	if names := taken[0].names; len(names) != 2 || names[0] != "a.js" || names[1] != "b.js" {
+		t.Fatalf("assets names %v", names)
+	}
+	if taken[1].names != nil {
+		t.Fatalf("src names %v, want the whole dir", taken[1].names)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+const (
+	minChunk = 64 << 10
+	maxChunk = 16 << 20
+	// an adaptive chunk takes about this long to send, small files wait at most that
+	chunkTime = 250 * time.Millisecond
+	// pings answered slower than this mean the link is queued up
+	congestedRTT = 4 * chunkTime
+)
+
+func clampChunk(size int) int {
+	if size < minChunk {
+		return minChunk
+	}
+	if size > maxChunk {
+		return maxChunk
+	}
+	return size
+}
+
+// adaptChunk returns the next chunk size from the current one, the write speed
+// in bytes per second and the ping RTT, zero ones are not measured yet
+func adaptChunk(cur int, speed float64, rtt time.Duration) int {
+	if rtt > congestedRTT {
+		return clampChunk(cur / 2)
+	}
+	if speed <= 0 {
+		return cur
+	}
+	size := int(speed * chunkTime.Seconds())
+	// grow slowly, a burst of speed may be the pipe buffer filling up
+	if size > 2*cur {
+		size = 2 * cur
+	}
+	return clampChunk(size)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptChunk(t *testing.T) {
+	cases := []struct {
+		cur   int
+		speed float64
+		rtt   time.Duration
+		want  int
+	}{
+		// nothing measured yet
+		{2 << 20, 0, 0, 2 << 20},
+		// a fast link grows the chunk, at most twice at a time
+		{2 << 20, 1 << 30, 10 * time.Millisecond, 4 << 20},
+		{maxChunk, 1 << 30, 10 * time.Millisecond, maxChunk},
+		// a chunk takes about chunkTime at the measured speed
+		{2 << 20, 1 << 20, 100 * time.Millisecond, 256 << 10},
+		{minChunk, 1 << 10, 0, minChunk},
+		// a queued up link halves it
+		{2 << 20, 1 << 30, 2 * time.Second, 1 << 20},
+	}
+	for _, c := range cases {
+		if got := adaptChunk(c.cur, c.speed, c.rtt); got != c.want {
+			t.Errorf("adaptChunk(%d, %v, %v) = %d, want %d", c.cur, c.speed, c.rtt, got, c.want)
+		}
+	}
+}
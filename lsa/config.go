@@ -0,0 +1,238 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Projects []ProjectConfig `json:"projects"`
+	// root and spaces at the top level are a shorthand for a single project
+	ProjectConfig
+	// KiB/s all the spaces may send together, 0 is unlimited
+	Bwlimit int `json:"bwlimit"`
+	// host groups a space spec names as @name, members may use braces or name other groups
+	Groups map[string][]string `json:"groups"`
+}
+
+type ProjectConfig struct {
+	Root   string        `json:"root"`
+	Spaces []SpaceConfig `json:"spaces"`
+	// bytes the event log may hold for lagging spaces before they need a full resync
+	EventLogMemory int `json:"event_log_memory"`
+	// quiet period a dir waits for after its last change before it is diffed
+	Debounce Duration `json:"debounce"`
+	// longest a changed dir waits however often it changes
+	MaxDelay Duration `json:"max_delay"`
+	// changes in one diff round or dirs pending that make an event storm, negative disables bulk mode
+	BulkThreshold int `json:"bulk_threshold"`
+	// quiet period after which a storm is over and its subtree is synced in bulk
+	BulkSettle Duration `json:"bulk_settle"`
+	// dirs read at once by the initial scan
+	ScanWorkers int `json:"scan_workers"`
+	// big files streamed to a space at once, the rest wait in line
+	BigStreams int `json:"big_streams"`
+	// files bigger than this are streamed in chunks
+	BigThreshold int `json:"big_threshold"`
+	// bytes of a big file chunk, with adaptive_chunks the size to start from
+	ChunkSize int `json:"chunk_size"`
+	// tune the chunk size of every space from its throughput and ping RTT
+	AdaptiveChunks bool `json:"adaptive_chunks"`
+	// spaces stage each diff round and commit it together once all are ready, if one fails none commits,
+	// storms, big files and files retried after their round was being changed are synced outside
+	// of the rounds and counted as unbarriered by the spaces
+	Barrier bool `json:"barrier"`
+	// how long a round waits for every space to be ready before it is aborted
+	BarrierTimeout Duration `json:"barrier_timeout"`
+	// classes of paths sent before or after the rest
+	Priorities []PriorityConfig `json:"priorities"`
+}
+
+const (
+	defaultDebounce = 400 * time.Millisecond
+	defaultMaxDelay = 2 * time.Second
+
+	defaultBulkThreshold = 5000
+	defaultBulkSettle    = 2 * time.Second
+
+	defaultBigStreams   = 2
+	defaultBigThreshold = 2 << 20
+	defaultChunkSize    = 2 << 20
+
+	defaultBarrierTimeout = 30 * time.Second
+)
+
+// Duration is a time.Duration written as "400ms" in json
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) Or(def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+func (c ProjectConfig) bulkThreshold() int {
+	if c.BulkThreshold == 0 {
+		return defaultBulkThreshold
+	}
+	return c.BulkThreshold
+}
+
+func (c ProjectConfig) scanWorkers() int {
+	if c.ScanWorkers <= 0 {
+		return defaultScanWorkers
+	}
+	return c.ScanWorkers
+}
+
+func (c ProjectConfig) bigStreams() int {
+	if c.BigStreams <= 0 {
+		return defaultBigStreams
+	}
+	return c.BigStreams
+}
+
+func (c ProjectConfig) bigThreshold() int {
+	if c.BigThreshold <= 0 {
+		return defaultBigThreshold
+	}
+	return c.BigThreshold
+}
+
+func (c ProjectConfig) chunkSize() int {
+	if c.ChunkSize <= 0 {
+		return defaultChunkSize
+	}
+	return clampChunk(c.ChunkSize)
+}
+
+type SpaceConfig struct {
+	Spec string `json:"spec"`
+	// KiB/s for big files and rsync, 0 is unlimited
+	Bwlimit int `json:"bwlimit"`
+	// lsa-space stages small writes and deletes of a diff round and shows them at once
+	Transactions bool `json:"transactions"`
+	// releases kept in release mode, changes go to dir/releases/next and dir/current
+	// is switched to it at every sync point, 0 syncs into dir itself; every switch
+	// hard-links the whole tree into the new next release, so it costs as much as
+	// the tree has files and dirs however small the change was
+	Releases int `json:"releases"`
+	// lsa-space of the space forwards the stream to these, acks wait for all of them
+	Relay []lsa.Relay `json:"relay"`
+	// host group the space was expanded from, empty for a single host
+	Group string `json:"-"`
+}
+
+// UnmarshalJSON accepts both "user@host:dir" and {"spec": "user@host:dir"}
+func (c *SpaceConfig) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &c.Spec)
+	}
+	type plain SpaceConfig
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+func LoadConfig(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("config %s: %v", file, err)
+	}
+	if len(c.Root) > 0 {
+		c.Projects = append(c.Projects, c.ProjectConfig)
+		c.ProjectConfig = ProjectConfig{}
+	} else if len(c.Spaces) > 0 {
+		return nil, fmt.Errorf("config %s: spaces without root", file)
+	}
+	if len(c.Projects) == 0 {
+		return nil, fmt.Errorf("config %s: no projects", file)
+	}
+	roots := make(map[string]bool)
+	for i := range c.Projects {
+		root, err := filepath.Abs(c.Projects[i].Root)
+		if err != nil {
+			return nil, err
+		}
+		if roots[root] {
+			return nil, fmt.Errorf("config %s: duplicate root %s", file, root)
+		}
+		roots[root] = true
+		c.Projects[i].Root = root
+		if c.Projects[i].Spaces, err = expandSpaces(c.Projects[i].Spaces, c.Groups); err != nil {
+			return nil, fmt.Errorf("config %s: %v", file, err)
+		}
+		if err = checkSpaces(c.Projects[i].Spaces); err != nil {
+			return nil, fmt.Errorf("config %s: root %s: %v", file, root, err)
+		}
+		for _, pc := range c.Projects[i].Priorities {
+			if err := checkGlob(pc.Glob); err != nil {
+				return nil, fmt.Errorf("config %s: priority glob %q: %v", file, pc.Glob, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func ArgsConfig(args []string) (*Config, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("args needed")
+	}
+	root, err := filepath.Abs(args[0])
+	if err != nil {
+		return nil, err
+	}
+	p := ProjectConfig{Root: root}
+	for _, arg := range args[1:] {
+		p.Spaces = append(p.Spaces, SpaceConfig{Spec: arg})
+	}
+	if p.Spaces, err = expandSpaces(p.Spaces, nil); err != nil {
+		return nil, err
+	}
+	if err = checkSpaces(p.Spaces); err != nil {
+		return nil, err
+	}
+	return &Config{Projects: []ProjectConfig{p}}, nil
+}
+
+// checkSpaces refuses bad specs and ones given twice, groups expanded, so a
+// reload fails before anything is applied
+func checkSpaces(confs []SpaceConfig) error {
+	specs := make(map[string]bool)
+	for _, conf := range confs {
+		// NewSpace takes host and dir apart at the only colon
+		if strings.Count(conf.Spec, ":") != 1 {
+			return fmt.Errorf("bad host:dir spec: %s", conf.Spec)
+		}
+		if specs[conf.Spec] {
+			return fmt.Errorf("duplicate space %s", conf.Spec)
+		}
+		specs[conf.Spec] = true
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigSpaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsa-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "lsa.json")
+	for conf, ok := range map[string]bool{
+		`{"root": "/p", "spaces": ["h1:/www", "h2:/www"]}`:                                             true,
+		`{"root": "/p", "spaces": ["h1:/www", "h1:/www"]}`:                                             false,
+		`{"root": "/p", "spaces": ["h{1..2}:/www", "h2:/www"]}`:                                        false,
+		`{"groups": {"web": ["h1", "h2"]}, "root": "/p", "spaces": ["@web:/www", "h1:/www"]}`:          false,
+		`{"root": "/p", "spaces": ["h1:/www:x"]}`:                                                      false,
+		`{"projects": [{"root": "/p", "spaces": ["h1:/www"]}, {"root": "/q", "spaces": ["h1:/www"]}]}`: true,
+	} {
+		if err = ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadConfig(file); (err == nil) != ok {
+			t.Errorf("%s: %v", conf, err)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"eelf.ru/lsa"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var controlSocket = flag.String("control", defaultControlSocket(), "unix socket for subcommands")
+var controlJson = flag.Bool("json", false, "print subcommand result as json")
+var controlTimeout = flag.Duration("timeout", time.Minute, "subcommand timeout")
+
+func defaultControlSocket() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "lsa.sock")
+	}
+	return filepath.Join(home, ".lsa.sock")
+}
+
+type controlRequest struct {
+	Cmd     string        `json:"cmd"`
+	Args    []string      `json:"args"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+type controlResponse struct {
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+type controlCommand struct {
+	usage  string
+	handle func(ctx context.Context, args []string) (interface{}, error)
+	print  func(result json.RawMessage) error
+}
+
+var controlCommands map[string]controlCommand
+
+func init() {
+	controlCommands = map[string]controlCommand{
+		"status": {"status [space|group...]", ctlStatus, printStatus},
+		"pause":  {"pause <space>", ctlPause, nil},
+		"resume": {"resume <space>", ctlResume, nil},
+		"resync": {"resync <space> [path]", ctlResync, nil},
+		"ls":     {"ls <path>", ctlLs, printLs},
+		"reload": {"reload", ctlReload, nil},
+		"flush":  {"flush", ctlFlush, nil},
+		"wait":   {"wait [space...]", ctlWait, nil},
+		"limit":  {"limit <KiB/s> [space]", ctlLimit, nil},
+	}
+	flag.Usage = usage
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: lsa [flags] <root> <[user@]host:dir>...")
+	fmt.Fprintln(out, "       lsa [flags] -config <file>")
+	var names []string
+	for name := range controlCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(out, "       lsa [flags]", controlCommands[name].usage)
+	}
+	flag.PrintDefaults()
+}
+
+var mainCalls = make(chan func(projectSet))
+
+// withProjects runs f in the main loop which owns the projects
+func withProjects(f func(projectSet)) {
+	done := make(chan struct{})
+	mainCalls <- func(ps projectSet) {
+		f(ps)
+		close(done)
+	}
+	<-done
+}
+
+// findSpace looks a space up by its spec or, when it is unambiguous, by host
+func findSpace(ps projectSet, name string) (*Space, error) {
+	var found []*Space
+	for _, p := range ps {
+		for spec, s := range p.spaces {
+			if spec == name || s.host == name {
+				found = append(found, s)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no space %s", name)
+	}
+	if len(found) > 1 {
+		return nil, fmt.Errorf("space %s is ambiguous, use user@host:dir", name)
+	}
+	return found[0], nil
+}
+
+func groupSpaces(ps projectSet, group string) []*Space {
+	var res []*Space
+	for _, p := range ps {
+		for _, s := range p.spaces {
+			if s.conf.Group == group {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+func lookupSpace(name string) (s *Space, err error) {
+	withProjects(func(ps projectSet) {
+		s, err = findSpace(ps, name)
+	})
+	return
+}
+
+// findProject returns the innermost project containing the absolute path and the path relative to its root
+func findProject(ps projectSet, abs string) (*Project, string, error) {
+	var owner *Project
+	for _, p := range ps {
+		if p.owns(abs) && (owner == nil || len(p.root) > len(owner.root)) {
+			owner = p
+		}
+	}
+	if owner == nil {
+		return nil, "", fmt.Errorf("%s is not in any project", abs)
+	}
+	rel, err := filepath.Rel(owner.root, abs)
+	return owner, rel, err
+}
+
+func ctlStatus(ctx context.Context, args []string) (interface{}, error) {
+	var res []SpaceStatus
+	var err error
+	withProjects(func(ps projectSet) {
+		if len(args) > 0 {
+			for _, name := range args {
+				if group := groupSpaces(ps, name); len(group) > 0 {
+					for _, s := range group {
+						res = append(res, s.status())
+					}
+					continue
+				}
+				var s *Space
+				if s, err = findSpace(ps, name); err != nil {
+					return
+				}
+				res = append(res, s.status())
+			}
+			return
+		}
+		for _, p := range ps {
+			for _, s := range p.spaces {
+				res = append(res, s.status())
+			}
+		}
+	})
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Project != res[j].Project {
+			return res[i].Project < res[j].Project
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res, err
+}
+
+func ctlPause(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("space needed")
+	}
+	s, err := lookupSpace(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s.setPaused(true)
+	return nil, nil
+}
+
+func ctlResume(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("space needed")
+	}
+	s, err := lookupSpace(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s.setPaused(false)
+	return nil, nil
+}
+
+// ctlLimit sets the bandwidth limit of a space or without one the global limit, 0 is unlimited
+func ctlLimit(ctx context.Context, args []string) (res interface{}, err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("limit and optional space needed")
+	}
+	rate, err := strconv.Atoi(args[0])
+	if err != nil || rate < 0 {
+		return nil, fmt.Errorf("bad limit %s", args[0])
+	}
+	withProjects(func(ps projectSet) {
+		if len(args) == 1 {
+			ps.setGlobalLimit(rate)
+			return
+		}
+		var s *Space
+		if s, err = findSpace(ps, args[1]); err != nil {
+			return
+		}
+		log.Println(s.host, "bandwidth limit", rate, "KiB/s")
+		s.setLimit(rate)
+	})
+	return
+}
+
+func ctlResync(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("space and optional path needed")
+	}
+	s, err := lookupSpace(args[0])
+	if err != nil {
+		return nil, err
+	}
+	path := "."
+	if len(args) == 2 {
+		path = args[1]
+		if filepath.IsAbs(path) {
+			if !s.project.owns(path) {
+				return nil, fmt.Errorf("%s is not in %s", path, s.project)
+			}
+			if path, err = filepath.Rel(s.project.root, path); err != nil {
+				return nil, err
+			}
+		}
+		path = filepath.Clean(path)
+		if path == ".." || strings.HasPrefix(path, "../") {
+			return nil, fmt.Errorf("%s is outside of %s", args[1], s.project)
+		}
+	}
+	return nil, s.resync(path)
+}
+
+type LsEntry struct {
+	Name  string    `json:"name"`
+	IsDir bool      `json:"is_dir"`
+	Link  bool      `json:"is_link"`
+	Mode  string    `json:"mode"`
+	Mtime time.Time `json:"mtime"`
+	Size  int64     `json:"size"`
+}
+
+type LsResult struct {
+	Project string    `json:"project"`
+	Path    string    `json:"path"`
+	Entry   *LsEntry  `json:"entry,omitempty"`
+	Entries []LsEntry `json:"entries,omitempty"`
+}
+
+func newLsEntry(name string, st *lsa.Stat) LsEntry {
+	return LsEntry{
+		Name:  name,
+		IsDir: st.IsDir(),
+		Link:  st.IsLink(),
+		Mode:  fmt.Sprintf("%o", st.Mode()),
+		Mtime: time.Unix(st.Mtime(), 0),
+		Size:  st.Size(),
+	}
+}
+
+func ctlLs(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) != 1 || !filepath.IsAbs(args[0]) {
+		return nil, fmt.Errorf("absolute path needed")
+	}
+	var p *Project
+	var err error
+	res := LsResult{}
+	withProjects(func(ps projectSet) {
+		p, res.Path, err = findProject(ps, filepath.Clean(args[0]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Project = p.root
+
+	err = p.do(ctx, func() {
+		if res.Path != "." {
+			dir, name := filepath.Split(res.Path)
+			if len(dir) == 0 {
+				dir = "."
+			}
+			if st, ok := p.repo.Get(filepath.Clean(dir), name); ok {
+				e := newLsEntry(name, &st)
+				res.Entry = &e
+			}
+		}
+		for name, st := range p.repo.GetDirStat(res.Path) {
+			st := st
+			res.Entries = append(res.Entries, newLsEntry(name, &st))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s is busy: %v", p, err)
+	}
+	if res.Entry == nil && res.Entries == nil && res.Path != "." {
+		return nil, fmt.Errorf("%s is not tracked", args[0])
+	}
+	sort.Slice(res.Entries, func(i, j int) bool { return res.Entries[i].Name < res.Entries[j].Name })
+	return res, nil
+}
+
+func ctlReload(ctx context.Context, args []string) (res interface{}, err error) {
+	withProjects(func(ps projectSet) {
+		err = reload(ps)
+	})
+	return
+}
+
+// routePending passes paths already reported by the watcher to their projects
+func routePending(ps projectSet) {
+	for len(watchCh) > 0 {
+		ps.route(<-watchCh)
+	}
+}
+
+func flushProjects(ctx context.Context, projects []*Project) error {
+	for _, p := range projects {
+		if err := p.flush(ctx); err != nil {
+			return fmt.Errorf("%s flush: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func ctlFlush(ctx context.Context, args []string) (interface{}, error) {
+	var projects []*Project
+	withProjects(func(ps projectSet) {
+		routePending(ps)
+		for _, p := range ps {
+			projects = append(projects, p)
+		}
+	})
+	return nil, flushProjects(ctx, projects)
+}
+
+// ctlWait returns when every change seen before the call is applied by the spaces
+func ctlWait(ctx context.Context, args []string) (interface{}, error) {
+	var spaces []*Space
+	var err error
+	withProjects(func(ps projectSet) {
+		routePending(ps)
+		if len(args) > 0 {
+			for _, name := range args {
+				var s *Space
+				if s, err = findSpace(ps, name); err != nil {
+					return
+				}
+				spaces = append(spaces, s)
+			}
+			return
+		}
+		for _, p := range ps {
+			for _, s := range p.spaces {
+				spaces = append(spaces, s)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var projects []*Project
+	seen := make(map[*Project]bool)
+	for _, s := range spaces {
+		if !seen[s.project] {
+			seen[s.project] = true
+			projects = append(projects, s.project)
+		}
+	}
+	if err = flushProjects(ctx, projects); err != nil {
+		return nil, err
+	}
+	heads := make(map[*Project]uint64)
+	for _, p := range projects {
+		heads[p] = p.eventLog.Head()
+	}
+
+	var errs []string
+	for _, s := range spaces {
+		if err := s.waitAcked(ctx, heads[s.project]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil, nil
+}
+
+func serveControl(file string) error {
+	if c, err := net.Dial("unix", file); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is used by another lsa", file)
+	}
+	os.Remove(file)
+	l, err := net.Listen("unix", file)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				log.Println("control accept:", err)
+				return
+			}
+			go handleControl(c)
+		}
+	}()
+	return nil
+}
+
+func handleControl(c net.Conn) {
+	defer c.Close()
+	var req controlRequest
+	if err := json.NewDecoder(bufio.NewReader(c)).Decode(&req); err != nil {
+		log.Println("control request:", err)
+		return
+	}
+	var resp controlResponse
+	if cmd, ok := controlCommands[req.Cmd]; ok {
+		ctx, cancel := context.WithTimeout(context.Background(), req.Timeout)
+		res, err := cmd.handle(ctx, req.Args)
+		cancel()
+		resp.Result = res
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	} else {
+		resp.Error = fmt.Sprintf("unknown command %s", req.Cmd)
+	}
+	if err := json.NewEncoder(c).Encode(resp); err != nil {
+		log.Println("control response:", err)
+	}
+}
+
+// runControl sends a subcommand to the running lsa and prints the result, returns exit code
+func runControl(args []string) int {
+	cmd := controlCommands[args[0]]
+	req := controlRequest{Cmd: args[0], Args: args[1:], Timeout: *controlTimeout}
+	if req.Cmd == "ls" && len(req.Args) == 1 {
+		abs, err := filepath.Abs(req.Args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		req.Args[0] = abs
+	}
+
+	c, err := net.Dial("unix", *controlSocket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lsa is not running:", err)
+		return 1
+	}
+	defer c.Close()
+	if err = json.NewEncoder(c).Encode(req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var resp struct {
+		Error  string          `json:"error"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err = json.NewDecoder(c).Decode(&resp); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(resp.Error) > 0 {
+		fmt.Fprintln(os.Stderr, args[0]+":", resp.Error)
+		return 1
+	}
+	if *controlJson {
+		if len(resp.Result) > 0 {
+			fmt.Println(string(resp.Result))
+		}
+		return 0
+	}
+	if cmd.print != nil {
+		if err = cmd.print(resp.Result); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func printStatus(result json.RawMessage) error {
+	var res []SpaceStatus
+	if err := json.Unmarshal(result, &res); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SPACE\tSTATE\tBACKLOG\tSPEED\tFILES/S\tLATENCY\tLIMIT\tCONNECTED\tLAST ERROR")
+	for _, st := range res {
+		state := st.State
+		if st.Paused && st.State != "paused" {
+			state += " (paused)"
+		}
+		since := "-"
+		if !st.Since.IsZero() {
+			since = time.Since(st.Since).Truncate(time.Second).String()
+		}
+		lastErr := "-"
+		if len(st.LastError) > 0 {
+			lastErr = st.LastErrorTime.Format(time.RFC3339) + " " + strings.SplitN(st.LastError, "\n", 2)[0]
+		}
+		limit := "-"
+		if st.Limit > 0 {
+			limit = fmtSize(st.Limit<<10) + "ps"
+		}
+		latency := "-"
+		if st.LatencyMax > 0 {
+			latency = fmt.Sprintf("%v/%v", st.Latency.Truncate(time.Millisecond), st.LatencyMax.Truncate(time.Millisecond))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%sps\t%.1f\t%s\t%s\t%s\t%s\n", st.Name, state, st.Backlog, fmtSize(int(st.Speed)), st.FileRate, latency, limit, since, lastErr)
+	}
+	if groups := groupStatuses(res); len(groups) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "GROUP\tSPACES\tCONNECTED\tSYNCED\tPAUSED\tBACKLOG\tSPEED\tERRORS")
+		for _, g := range groups {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%sps\t%d\n", g.Name, g.Spaces, g.Connected, g.Synced, g.Paused, g.Backlog, fmtSize(int(g.Speed)), g.Errors)
+		}
+	}
+	return w.Flush()
+}
+
+func printLs(result json.RawMessage) error {
+	var res LsResult
+	if err := json.Unmarshal(result, &res); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	line := func(e LsEntry) {
+		typ := "-"
+		if e.IsDir {
+			typ = "d"
+		} else if e.Link {
+			typ = "l"
+		}
+		fmt.Fprintf(w, "%s%s\t%d\t%s\t%s\n", typ, e.Mode, e.Size, e.Mtime.Format(time.RFC3339), e.Name)
+	}
+	if res.Entry != nil {
+		line(*res.Entry)
+	}
+	for _, e := range res.Entries {
+		line(e)
+	}
+	return w.Flush()
+}
@@ -4,56 +4,109 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"unsafe"
 )
 
-const eventsPerChunk = 1<<10
+const eventsPerGet = 1 << 10
+
+const defaultEventLogMemory = 64 << 20
 
 type Event struct {
 	dir, name string
 	isDelete  bool
+	// bulk asks to rsync the whole dir, it stands for changes of an event storm
+	bulk bool
+	// last event of an Add, changes up to it make a consistent tree
+	roundEnd bool
+	seq      uint64
+	// seq of the oldest event collapsed into this one, 0 if none
+	since uint64
+	// unix nanoseconds of the first fs change the event stands for
+	changed int64
+}
+
+func (e *Event) strBytes() int {
+	return len(e.dir) + len(e.name)
 }
 
-type eventsChunk []Event
+// GapError means the client fell behind the retained events and has to resync everything up to Seq
+type GapError struct {
+	Seq uint64
+}
+
+func (e *GapError) Error() string {
+	return fmt.Sprintf("event log gap, full resync required up to #%d", e.Seq)
+}
 
 type client struct {
 	notify chan struct{}
-	chunks []*eventsChunk
-	pos    int
+	// seq of the last event taken by the client
+	cursor uint64
+	// with rounds Get stops at the end of a round and events after hold are
+	// kept even when taken, so an aborted round can be taken again
+	rounds bool
+	hold   uint64
 }
 
+// EventLog keeps events in a ring until every client has taken them or the memory limit is hit
 type EventLog struct {
-	clients   map[string]*client
-	chunk     *eventsChunk
-	mu        sync.Mutex
+	clients map[string]*client
+	ring    []Event
+	start   int
+	n       int
+	// bytes of strings held by the ring
+	bytes int
+	limit int
+	seq   uint64
+	mu    sync.Mutex
 }
 
 func NewEventLog() EventLog {
-	return EventLog{clients: make(map[string]*client), chunk: new(eventsChunk)}
+	return EventLog{clients: make(map[string]*client), limit: defaultEventLogMemory}
+}
+
+// SetLimit sets the memory the retained events may use
+func (l *EventLog) SetLimit(bytes int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bytes <= 0 {
+		bytes = defaultEventLogMemory
+	}
+	l.limit = bytes
+	l.enforceLimit()
 }
 
-func (l *EventLog) AddClient(name string) {
+// AddClient returns the seq of the last event added before the client
+func (l *EventLog) AddClient(name string) uint64 {
 	ch := make(chan struct{}, 1)
 	l.mu.Lock()
-	l.clients[name] = &client{notify: ch, chunks: []*eventsChunk{l.chunk}}
-	l.mu.Unlock()
+	defer l.mu.Unlock()
+	l.clients[name] = &client{notify: ch, cursor: l.seq}
+	return l.seq
 }
 
 func (l *EventLog) RemoveClient(name string) {
 	l.mu.Lock()
 	delete(l.clients, name)
+	l.trim()
 	l.mu.Unlock()
 }
 
+// Add appends events of one diff round
 func (l *EventLog) Add(e []Event) {
+	if len(e) == 0 {
+		return
+	}
+	e[len(e)-1].roundEnd = true
 	l.mu.Lock()
-	*l.chunk = append(*l.chunk, e...)
-
-	if len(*l.chunk) >= eventsPerChunk {
-		l.chunk = new(eventsChunk)
-		for _, client := range l.clients {
-			client.chunks = append(client.chunks, l.chunk)
+	for i := range e {
+		l.seq++
+		e[i].seq = l.seq
+		if len(l.clients) > 0 {
+			l.push(e[i])
 		}
 	}
+	l.enforceLimit()
 
 	for _, client := range l.clients {
 		select {
@@ -64,10 +117,15 @@ func (l *EventLog) Add(e []Event) {
 	l.mu.Unlock()
 }
 
-func (l *EventLog) Get(name string, ctx context.Context) (res []Event) {
+// Get waits for events after the client cursor and returns at most eventsPerGet of them,
+// *GapError is returned when some of them are already dropped
+func (l *EventLog) Get(name string, ctx context.Context) (res []Event, err error) {
 	l.mu.Lock()
-	client := l.clients[name]
+	client, ok := l.clients[name]
 	l.mu.Unlock()
+	if !ok {
+		return
+	}
 
 	select {
 	case <-client.notify:
@@ -77,25 +135,263 @@ func (l *EventLog) Get(name string, ctx context.Context) (res []Event) {
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	chunks := len(client.chunks)
-	if chunks > 1 {
-		res = append(res, (*client.chunks[0])[client.pos:]...)
-		client.pos = 0
-
-		copy(client.chunks, client.chunks[1:])
-		client.chunks = client.chunks[0:chunks-1]
-
+	if client.cursor < l.first()-1 {
+		client.cursor = l.seq
+		// the full resync covers the held events too
+		client.hold = l.seq
+		l.trim()
+		return nil, &GapError{Seq: l.seq}
+	}
+	n := int(l.seq - client.cursor)
+	if n > eventsPerGet {
+		n = eventsPerGet
+	}
+	if client.rounds {
+		for i := 0; i < n; i++ {
+			if l.at(client.cursor + 1 + uint64(i)).roundEnd {
+				n = i + 1
+				break
+			}
+		}
+	}
+	if client.cursor+uint64(n) < l.seq {
 		select {
 		case client.notify <- struct{}{}:
 		default:
 		}
-	} else if len(*client.chunks[0]) > client.pos {
-		res = append(res, (*client.chunks[0])[client.pos:]...)
-		client.pos = len(*client.chunks[0])
 	}
-	return
+	if n > 0 {
+		res = make([]Event, n)
+		for i := range res {
+			res[i] = l.at(client.cursor + 1 + uint64(i))
+		}
+		client.cursor += uint64(n)
+		l.trim()
+	}
+	return coalesce(res), nil
+}
+
+type eventKey struct {
+	dir, name string
+}
+
+// coalesce leaves one event per path: it takes the place of the first one so
+// parent dirs still go before their content, and the state and seq of the last one.
+// A path deleted and created again keeps the delete right before the write, a
+// dir must not be written over the old one nor keep its old content
+func coalesce(evs []Event) []Event {
+	if len(evs) < 2 {
+		return evs
+	}
+	pos := make(map[eventKey]int, len(evs))
+	// deletes kept before the write at the same index of res
+	dels := make(map[int]Event)
+	res := evs[:0]
+	for _, ev := range evs {
+		key := eventKey{ev.dir, ev.name}
+		i, ok := pos[key]
+		if !ok {
+			pos[key] = len(res)
+			res = append(res, ev)
+			continue
+		}
+		if res[i].isDelete && !ev.isDelete {
+			dels[i] = res[i]
+			res[i] = ev
+			continue
+		}
+		since, changed := res[i].Since(), res[i].changed
+		if del, ok := dels[i]; ok && ev.isDelete {
+			// deleted again, the single delete stands for the whole run
+			since, changed = del.Since(), del.changed
+			delete(dels, i)
+		}
+		res[i] = ev
+		res[i].since = since
+		if changed != 0 && changed < ev.changed {
+			res[i].changed = changed
+		}
+	}
+	if len(dels) == 0 {
+		return res
+	}
+	out := make([]Event, 0, len(res)+len(dels))
+	for i, ev := range res {
+		if del, ok := dels[i]; ok {
+			out = append(out, del)
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// Since returns the seq of the oldest change the event stands for
+func (e *Event) Since() uint64 {
+	if e.since != 0 {
+		return e.since
+	}
+	return e.seq
+}
+
+// HoldRounds makes Get of the client stop at round ends and keeps the events
+// after seq for Rewind until Settle moves past them
+func (l *EventLog) HoldRounds(name string, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if client, ok := l.clients[name]; ok {
+		client.rounds = true
+		client.hold = seq
+	}
+}
+
+// Settle lets go of events up to seq, they will not be taken again
+func (l *EventLog) Settle(name string, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if client, ok := l.clients[name]; ok && seq > client.hold {
+		client.hold = seq
+		l.trim()
+	}
+}
+
+// Skip moves the client past the events added so far, they are synced by other
+// means, and returns the seq of the last one
+func (l *EventLog) Skip(name string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if client, ok := l.clients[name]; ok {
+		client.cursor, client.hold = l.seq, l.seq
+		l.trim()
+	}
+	return l.seq
+}
+
+// Rewind gives the events after the last Settle to the client again, a gap
+// is reported when the memory limit has dropped them meanwhile
+func (l *EventLog) Rewind(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	client, ok := l.clients[name]
+	if !ok || !client.rounds {
+		return
+	}
+	client.cursor = client.hold
+	select {
+	case client.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Clients returns the names of the clients
+func (l *EventLog) Clients() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	names := make([]string, 0, len(l.clients))
+	for name := range l.clients {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Head returns the seq of the last added event
+func (l *EventLog) Head() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Pending returns the number of events not yet taken by the client
+func (l *EventLog) Pending(name string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	client, ok := l.clients[name]
+	if !ok {
+		return 0
+	}
+	return int(l.seq - client.cursor)
+}
+
+func (l *EventLog) memory() int {
+	return l.bytes + len(l.ring)*int(unsafe.Sizeof(Event{}))
+}
+
+// first returns the seq of the oldest retained event
+func (l *EventLog) first() uint64 {
+	return l.seq - uint64(l.n) + 1
+}
+
+func (l *EventLog) at(seq uint64) Event {
+	return l.ring[(l.start+int(seq-l.first()))%len(l.ring)]
+}
+
+func (l *EventLog) push(e Event) {
+	if l.n == len(l.ring) {
+		l.resize(2 * len(l.ring))
+	}
+	l.ring[(l.start+l.n)%len(l.ring)] = e
+	l.n++
+	l.bytes += e.strBytes()
+}
+
+func (l *EventLog) pop() {
+	e := &l.ring[l.start]
+	l.bytes -= e.strBytes()
+	*e = Event{}
+	l.start = (l.start + 1) % len(l.ring)
+	l.n--
+}
+
+func (l *EventLog) resize(size int) {
+	if size < 16 {
+		size = 16
+	}
+	ring := make([]Event, size)
+	for i := 0; i < l.n; i++ {
+		ring[i] = l.ring[(l.start+i)%len(l.ring)]
+	}
+	l.ring = ring
+	l.start = 0
+}
+
+// trim drops events taken by every client
+func (l *EventLog) trim() {
+	min := l.seq
+	for _, client := range l.clients {
+		if client.cursor < min {
+			min = client.cursor
+		}
+		if client.rounds && client.hold < min {
+			min = client.hold
+		}
+	}
+	for l.n > 0 && l.first() <= min {
+		l.pop()
+	}
+	l.shrink()
+}
+
+// shrink gives back memory of a ring grown by a burst
+func (l *EventLog) shrink() {
+	size := len(l.ring)
+	for size > 1024 && l.n < size/4 {
+		size /= 2
+	}
+	if size != len(l.ring) {
+		l.resize(size)
+	}
+}
+
+// enforceLimit drops the oldest events over the memory limit, lagging clients get a gap
+func (l *EventLog) enforceLimit() {
+	for l.n > 0 && l.memory() > l.limit {
+		l.pop()
+		l.shrink()
+	}
 }
 
 func (e *Event) String() string {
-	return fmt.Sprintf("del:%t d:%s n:%s", e.isDelete, e.dir, e.name)
+	if e.bulk {
+		return fmt.Sprintf("#%d bulk d:%s", e.seq, e.dir)
+	}
+	return fmt.Sprintf("#%d del:%t d:%s n:%s", e.seq, e.isDelete, e.dir, e.name)
 }
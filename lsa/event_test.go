@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
@@ -12,14 +13,16 @@ func TestEventLog(t *testing.T) {
 
 	resCh := make(chan int)
 
+	// clients start at the head of the log
+	el.AddClient("kek")
 	go func() {
-		el.AddClient("kek")
 
 		streakNoEvents := 0
 		eventsProcessed := 0
 		for {
-			ctx, _ := context.WithTimeout(context.Background(), 10*time.Millisecond)
-			evs := el.Get("kek", ctx)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			evs, _ := el.Get("kek", ctx)
+			cancel()
 			if len(evs) == 0 {
 				streakNoEvents++
 				if streakNoEvents > 5 {
@@ -36,7 +39,7 @@ func TestEventLog(t *testing.T) {
 		resCh <- eventsProcessed
 	}()
 
-	e := Event{"dir", "yeee", true}
+	e := Event{dir: "dir", name: "yeee", isDelete: true}
 	for i := 0; i < 55; i++ {
 		e.dir = fmt.Sprint(i)
 		el.Add([]Event{e})
@@ -46,3 +49,234 @@ func TestEventLog(t *testing.T) {
 		t.Fatal("events processed", res, "want 55")
 	}
 }
+
+func TestEventLogGap(t *testing.T) {
+	el := NewEventLog()
+	el.SetLimit(100 << 10)
+	el.AddClient("slow")
+
+	for i := 0; i < 5000; i++ {
+		el.Add([]Event{{dir: "dir", name: fmt.Sprint(i)}})
+	}
+	if m := el.memory(); m > 100<<10 {
+		t.Fatalf("memory %d over limit", m)
+	}
+
+	_, err := el.Get("slow", context.Background())
+	gap, ok := err.(*GapError)
+	if !ok {
+		t.Fatalf("want gap have %v", err)
+	}
+	if gap.Seq != 5000 {
+		t.Fatalf("gap seq %d want 5000", gap.Seq)
+	}
+	if n := el.Pending("slow"); n != 0 {
+		t.Fatalf("pending %d after gap", n)
+	}
+
+	el.Add([]Event{{dir: "dir", name: "after"}})
+	evs, err := el.Get("slow", context.Background())
+	if err != nil || len(evs) != 1 || evs[0].name != "after" || evs[0].seq != 5001 {
+		t.Fatalf("after gap have %v %v", evs, err)
+	}
+}
+
+func TestEventLogTrim(t *testing.T) {
+	el := NewEventLog()
+	el.Add([]Event{{dir: "nobody", name: "listens"}})
+	if el.n != 0 {
+		t.Fatalf("%d events kept without clients", el.n)
+	}
+
+	el.AddClient("a")
+	el.AddClient("b")
+	for i := 0; i < 5000; i++ {
+		el.Add([]Event{{dir: "dir", name: fmt.Sprint(i)}})
+	}
+	for el.Pending("a") > 0 {
+		el.Get("a", context.Background())
+	}
+	if el.n != 5000 {
+		t.Fatalf("%d events kept, b has not taken any", el.n)
+	}
+	el.RemoveClient("b")
+	if el.n != 0 || el.bytes != 0 {
+		t.Fatalf("%d events %d bytes kept after every client took them", el.n, el.bytes)
+	}
+	if len(el.ring) > 2048 {
+		t.Fatalf("ring of %d is not shrunk", len(el.ring))
+	}
+}
+
+// TestEventLogConcurrent is meant to be run with -race
+func TestEventLogConcurrent(t *testing.T) {
+	const writers, perWriter, clients = 4, 5000, 8
+	el := NewEventLog()
+	for c := 0; c < clients; c++ {
+		el.AddClient(fmt.Sprint("c", c))
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, clients)
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			var last uint64
+			for last < writers*perWriter {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				evs, err := el.Get(name, ctx)
+				timedOut := ctx.Err() != nil
+				cancel()
+				if err != nil {
+					errCh <- fmt.Errorf("%s: %v", name, err)
+					return
+				}
+				if len(evs) == 0 && timedOut {
+					errCh <- fmt.Errorf("%s: stuck at %d", name, last)
+					return
+				}
+				for _, ev := range evs {
+					if ev.seq != last+1 {
+						errCh <- fmt.Errorf("%s: seq %d after %d", name, ev.seq, last)
+						return
+					}
+					last = ev.seq
+				}
+			}
+		}(fmt.Sprint("c", c))
+	}
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := 0; i < perWriter; i++ {
+				el.Add([]Event{{dir: fmt.Sprint(w), name: fmt.Sprint(i)}})
+				el.Pending("c0")
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+func BenchmarkEventLog(b *testing.B) {
+	el := NewEventLog()
+	el.AddClient("a")
+	evs := make([]Event, 100)
+	for i := range evs {
+		evs[i] = Event{dir: "some/dir", name: fmt.Sprint("file", i)}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		el.Add(evs)
+		el.Get("a", context.Background())
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	evs := []Event{
+		{dir: ".", name: "a", isDelete: true, seq: 1},
+		{dir: ".", name: "b", seq: 2},
+		{dir: ".", name: "a", seq: 3},
+		{dir: "a", name: "x", seq: 4},
+		{dir: ".", name: "b", seq: 5},
+		{dir: ".", name: "b", isDelete: true, seq: 6},
+		{dir: ".", name: "a", seq: 7},
+	}
+	want := []Event{
+		// deleted and created again: the delete, then a write
+		{dir: ".", name: "a", isDelete: true, seq: 1},
+		{dir: ".", name: "a", seq: 7, since: 3},
+		// written and deleted: a delete
+		{dir: ".", name: "b", isDelete: true, seq: 6, since: 2},
+		{dir: "a", name: "x", seq: 4},
+	}
+	res := coalesce(evs)
+	if len(res) != len(want) {
+		t.Fatalf("have %v want %v", res, want)
+	}
+	for i := range want {
+		if res[i] != want[i] {
+			t.Fatalf("%d: have %v want %v", i, res[i], want[i])
+		}
+	}
+	if res[3].Since() != 4 {
+		t.Fatalf("since of a single event %d", res[3].Since())
+	}
+
+	// created, deleted, created and deleted again: a single delete
+	evs = []Event{
+		{dir: ".", name: "c", isDelete: true, seq: 1},
+		{dir: ".", name: "c", seq: 2},
+		{dir: ".", name: "c", isDelete: true, seq: 3},
+	}
+	res = coalesce(evs)
+	if len(res) != 1 || res[0] != (Event{dir: ".", name: "c", isDelete: true, seq: 3, since: 1}) {
+		t.Fatalf("have %v", res)
+	}
+}
+
+func TestEventLogCoalesce(t *testing.T) {
+	el := NewEventLog()
+	el.AddClient("busy")
+	for i := 0; i < 50; i++ {
+		el.Add([]Event{{dir: "dir", name: "saved"}})
+	}
+	evs, err := el.Get("busy", context.Background())
+	if err != nil || len(evs) != 1 || evs[0].seq != 50 || evs[0].Since() != 1 {
+		t.Fatalf("have %v %v", evs, err)
+	}
+}
+
+func TestEventLogRounds(t *testing.T) {
+	el := NewEventLog()
+	el.AddClient("fleet")
+	el.HoldRounds("fleet", 0)
+	el.Add([]Event{{dir: "dir", name: "a"}, {dir: "dir", name: "b"}})
+	el.Add([]Event{{dir: "dir", name: "c"}})
+
+	evs, err := el.Get("fleet", context.Background())
+	if err != nil || len(evs) != 2 || !evs[1].roundEnd {
+		t.Fatalf("first round %v %v", evs, err)
+	}
+	// aborted, the round comes again
+	el.Rewind("fleet")
+	if evs, err = el.Get("fleet", context.Background()); err != nil || len(evs) != 2 || evs[0].name != "a" {
+		t.Fatalf("rewound round %v %v", evs, err)
+	}
+	el.Settle("fleet", 2)
+	if el.n != 1 {
+		t.Fatalf("%d events kept after the round settled", el.n)
+	}
+	if evs, err = el.Get("fleet", context.Background()); err != nil || len(evs) != 1 || evs[0].name != "c" {
+		t.Fatalf("second round %v %v", evs, err)
+	}
+	el.Rewind("fleet")
+	if evs, err = el.Get("fleet", context.Background()); err != nil || len(evs) != 1 || evs[0].name != "c" {
+		t.Fatalf("rewound second round %v %v", evs, err)
+	}
+}
+
+func TestEventLogSkip(t *testing.T) {
+	el := NewEventLog()
+	el.AddClient("paused")
+	el.HoldRounds("paused", 0)
+	el.Add([]Event{{dir: "dir", name: "a"}})
+	el.Add([]Event{{dir: "dir", name: "b"}})
+
+	if seq := el.Skip("paused"); seq != 2 {
+		t.Fatalf("skipped to %d", seq)
+	}
+	if el.n != 0 || el.Pending("paused") != 0 {
+		t.Fatalf("%d events kept, %d pending after the skip", el.n, el.Pending("paused"))
+	}
+	// a rewind does not give the skipped events again
+	el.Add([]Event{{dir: "dir", name: "c"}})
+	el.Rewind("paused")
+	evs, err := el.Get("paused", context.Background())
+	if err != nil || len(evs) != 1 || evs[0].name != "c" {
+		t.Fatalf("after the skip %v %v", evs, err)
+	}
+}
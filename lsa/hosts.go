@@ -0,0 +1,259 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// a typo in a range should not start a million spaces
+const maxGroupHosts = 10000
+
+// expandBraces expands {a,b} lists and {1..20} ranges like sh does, {01..20}
+// pads the numbers to the same width
+func expandBraces(s string) ([]string, error) {
+	start := strings.IndexByte(s, '{')
+	if start < 0 {
+		if strings.IndexByte(s, '}') >= 0 {
+			return nil, fmt.Errorf("unbalanced braces in %s", s)
+		}
+		return []string{s}, nil
+	}
+	// the matching brace and the commas at its level
+	end := -1
+	commas := []int{}
+	depth := 0
+	for i := start; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				end = i
+			}
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		}
+	}
+	if end < 0 {
+		return nil, fmt.Errorf("unbalanced braces in %s", s)
+	}
+	var alts []string
+	if len(commas) == 0 {
+		var err error
+		if alts, err = braceRange(s[start+1 : end]); err != nil {
+			return nil, fmt.Errorf("%s: %v", s, err)
+		}
+	} else {
+		from := start + 1
+		for _, c := range commas {
+			alts = append(alts, s[from:c])
+			from = c + 1
+		}
+		alts = append(alts, s[from:end])
+	}
+	prefix, suffix := s[:start], s[end+1:]
+	var res []string
+	for _, alt := range alts {
+		more, err := expandBraces(prefix + alt + suffix)
+		if err != nil {
+			return nil, err
+		}
+		if res = append(res, more...); len(res) > maxGroupHosts {
+			return nil, fmt.Errorf("%s expands to more than %d hosts", s, maxGroupHosts)
+		}
+	}
+	return res, nil
+}
+
+func braceRange(r string) ([]string, error) {
+	parts := strings.Split(r, "..")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("{%s} is neither a list nor a range", r)
+	}
+	from, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad range start %q", parts[0])
+	}
+	to, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad range end %q", parts[1])
+	}
+	step := 1
+	if to < from {
+		step = -1
+	}
+	if n := (to-from)*step + 1; n > maxGroupHosts {
+		return nil, fmt.Errorf("{%s} has more than %d numbers", r, maxGroupHosts)
+	}
+	width := 0
+	for _, p := range parts {
+		if len(p) > 1 && p[0] == '0' && len(p) > width {
+			width = len(p)
+		}
+	}
+	var res []string
+	for i := from; ; i += step {
+		res = append(res, fmt.Sprintf("%0*d", width, i))
+		if i == to {
+			break
+		}
+	}
+	return res, nil
+}
+
+// expandHosts expands a host pattern into [user@]host names, @name is the
+// named group which members are patterns themselves
+func expandHosts(pattern string, groups map[string][]string, seen map[string]bool) ([]string, error) {
+	if !strings.HasPrefix(pattern, "@") {
+		return expandBraces(pattern)
+	}
+	name := pattern[1:]
+	members, ok := groups[name]
+	if !ok {
+		return nil, fmt.Errorf("no host group %s", name)
+	}
+	if seen[name] {
+		return nil, fmt.Errorf("host group %s includes itself", name)
+	}
+	seen[name] = true
+	defer delete(seen, name)
+	var res []string
+	for _, m := range members {
+		hosts, err := expandHosts(m, groups, seen)
+		if err != nil {
+			return nil, err
+		}
+		if res = append(res, hosts...); len(res) > maxGroupHosts {
+			return nil, fmt.Errorf("host group %s has more than %d hosts", name, maxGroupHosts)
+		}
+	}
+	return res, nil
+}
+
+// expandSpec turns [user@]pattern:dir into specs of single hosts, the group
+// is the pattern when it may stand for more than one host
+func expandSpec(spec string, groups map[string][]string) (specs []string, group string, err error) {
+	i := strings.IndexByte(spec, ':')
+	if i < 0 {
+		return nil, "", fmt.Errorf("bad host:dir spec: %s", spec)
+	}
+	hostPart, dir := spec[:i], spec[i:]
+	user, pattern := "", hostPart
+	if j := strings.IndexByte(hostPart, '@'); j > 0 {
+		user, pattern = hostPart[:j+1], hostPart[j+1:]
+	}
+	if strings.HasPrefix(pattern, "@") {
+		group = pattern[1:]
+	} else if strings.ContainsAny(pattern, "{}") {
+		group = pattern
+	}
+	hosts, err := expandHosts(pattern, groups, make(map[string]bool))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, h := range hosts {
+		if !strings.Contains(h, "@") {
+			// a user in the group wins over the one of the spec
+			h = user + h
+		}
+		specs = append(specs, h+dir)
+	}
+	return specs, group, nil
+}
+
+// expandSpaces makes a space of every host of the groups, downstreams of relays
+// included, a relay has to be a single host as every downstream gets the
+// stream from one relay only
+func expandSpaces(confs []SpaceConfig, groups map[string][]string) ([]SpaceConfig, error) {
+	var res []SpaceConfig
+	for _, conf := range confs {
+		specs, group, err := expandSpec(conf.Spec, groups)
+		if err != nil {
+			return nil, err
+		}
+		if len(specs) > 1 && len(conf.Relay) > 0 {
+			return nil, fmt.Errorf("%s is %d hosts, a relay is a single one", conf.Spec, len(specs))
+		}
+		relays, err := expandRelays(conf.Relay, groups)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range specs {
+			c := conf
+			c.Spec, c.Group, c.Relay = spec, group, relays
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+func expandRelays(relays []lsa.Relay, groups map[string][]string) ([]lsa.Relay, error) {
+	var res []lsa.Relay
+	for _, r := range relays {
+		specs, _, err := expandSpec(r.Spec, groups)
+		if err != nil {
+			return nil, err
+		}
+		if len(specs) > 1 && len(r.Relay) > 0 {
+			return nil, fmt.Errorf("%s is %d hosts, a relay is a single one", r.Spec, len(specs))
+		}
+		sub, err := expandRelays(r.Relay, groups)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range specs {
+			res = append(res, lsa.Relay{Spec: spec, Relay: sub})
+		}
+	}
+	return res, nil
+}
+
+// GroupStatus sums up the spaces of a host group
+type GroupStatus struct {
+	Project   string `json:"project"`
+	Name      string `json:"name"`
+	Spaces    int    `json:"spaces"`
+	Connected int    `json:"connected"`
+	Synced    int    `json:"synced"`
+	Paused    int    `json:"paused"`
+	Backlog   int    `json:"backlog"`
+	Speed     uint   `json:"speed"`
+	Errors    uint64 `json:"errors"`
+}
+
+// groupStatuses sums up sts by group in the order the groups come
+func groupStatuses(sts []SpaceStatus) []GroupStatus {
+	var res []GroupStatus
+	idx := make(map[[2]string]int)
+	for _, st := range sts {
+		if st.Group == "" {
+			continue
+		}
+		key := [2]string{st.Project, st.Group}
+		i, ok := idx[key]
+		if !ok {
+			i = len(res)
+			idx[key] = i
+			res = append(res, GroupStatus{Project: st.Project, Name: st.Group})
+		}
+		g := &res[i]
+		g.Spaces++
+		if !st.Since.IsZero() {
+			g.Connected++
+		}
+		if st.State == "all synced" {
+			g.Synced++
+		}
+		if st.Paused {
+			g.Paused++
+		}
+		g.Backlog += st.Backlog
+		g.Speed += st.Speed
+		g.Errors += st.Errors
+	}
+	return res
+}
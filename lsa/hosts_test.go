@@ -0,0 +1,86 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"reflect"
+	"testing"
+)
+
+func TestExpandBraces(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []string
+	}{
+		{"www1", []string{"www1"}},
+		{"www{1..3}.d3", []string{"www1.d3", "www2.d3", "www3.d3"}},
+		{"db{08..10}", []string{"db08", "db09", "db10"}},
+		{"db{3..1}", []string{"db3", "db2", "db1"}},
+		{"{a,b{1..2}}.x", []string{"a.x", "b1.x", "b2.x"}},
+		{"{a,}c", []string{"ac", "c"}},
+	} {
+		got, err := expandBraces(c.in)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: %v %v, want %v", c.in, got, err, c.want)
+		}
+	}
+	for _, bad := range []string{"www{1..3", "www}", "www{x}", "www{1..a}", "h{1..100000}"} {
+		if got, err := expandBraces(bad); err == nil {
+			t.Errorf("%s: %v, want error", bad, got)
+		}
+	}
+}
+
+func TestExpandSpaces(t *testing.T) {
+	groups := map[string][]string{
+		"web": {"www{1..2}.d3", "root@api.d3"},
+		"all": {"@web", "db1"},
+		"a":   {"@b"},
+		"b":   {"@a"},
+	}
+	confs := []SpaceConfig{
+		{Spec: "deploy@@all:/var/www", Transactions: true},
+		{Spec: "h1:/srv", Relay: []lsa.Relay{{Spec: "e{1..2}:/srv"}}},
+		{Spec: "single:/srv"},
+	}
+	got, err := expandSpaces(confs, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relays := []lsa.Relay{{Spec: "e1:/srv"}, {Spec: "e2:/srv"}}
+	want := []SpaceConfig{
+		{Spec: "deploy@www1.d3:/var/www", Transactions: true, Group: "all"},
+		{Spec: "deploy@www2.d3:/var/www", Transactions: true, Group: "all"},
+		{Spec: "root@api.d3:/var/www", Transactions: true, Group: "all"},
+		{Spec: "deploy@db1:/var/www", Transactions: true, Group: "all"},
+		{Spec: "h1:/srv", Relay: relays},
+		{Spec: "single:/srv"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+
+	for _, spec := range []string{"@nope:/srv", "@a:/srv", "nodir"} {
+		if _, err := expandSpaces([]SpaceConfig{{Spec: spec}}, groups); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+	// every host would relay to the same downstreams
+	for _, conf := range []SpaceConfig{
+		{Spec: "h{1..2}:/srv", Relay: []lsa.Relay{{Spec: "e1:/srv"}}},
+		{Spec: "h1:/srv", Relay: []lsa.Relay{{Spec: "e{1..2}:/srv", Relay: []lsa.Relay{{Spec: "f1:/srv"}}}}},
+	} {
+		if _, err := expandSpaces([]SpaceConfig{conf}, groups); err == nil {
+			t.Errorf("%s: relay of many hosts accepted", conf.Spec)
+		}
+	}
+
+	sts := []SpaceStatus{
+		{Name: "h1:/srv", Project: "/p", Group: "h{1..2}", State: "all synced", Backlog: 1},
+		{Name: "single:/srv", Project: "/p", State: "syncing"},
+		{Name: "h2:/srv", Project: "/p", Group: "h{1..2}", State: "syncing", Backlog: 2, Errors: 3},
+	}
+	gs := groupStatuses(sts)
+	if len(gs) != 1 || gs[0].Spaces != 2 || gs[0].Synced != 1 || gs[0].Backlog != 3 || gs[0].Errors != 3 {
+		t.Fatalf("groups %+v", gs)
+	}
+}
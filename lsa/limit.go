@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the bytes sent per second, sends go into debt and the
+// next one waits until it is paid off
+type tokenBucket struct {
+	mu sync.Mutex
+	// KiB/s like rsync --bwlimit, 0 is unlimited
+	rate   int
+	tokens float64
+	last   time.Time
+	// KiB/s taken by running rsyncs, sends refill from the rest
+	reserved int
+}
+
+// globalLimit is shared by every space
+var globalLimit tokenBucket
+
+func (b *tokenBucket) setRate(rate int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	b.rate = rate
+	b.reserved = 0
+	b.tokens = 0
+	b.last = time.Time{}
+}
+
+func (b *tokenBucket) limit() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// free is the rate left for sends
+func (b *tokenBucket) free() int {
+	if free := b.rate - b.reserved; free > 1 {
+		return free
+	}
+	return 1
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	perSec := float64(b.free() << 10)
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * perSec
+	}
+	b.last = now
+	// a second worth of burst
+	if b.tokens > perSec {
+		b.tokens = perSec
+	}
+}
+
+// delay returns how long to wait before sending, zero when the bucket is not in debt
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.free()<<10) * float64(time.Second))
+}
+
+// spend takes n bytes sent
+func (b *tokenBucket) spend(now time.Time, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+// reserve takes half of the free rate for an rsync until release, 0 is unlimited
+func (b *tokenBucket) reserve() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	share := b.free() / 2
+	if share == 0 {
+		share = 1
+	}
+	b.reserved += share
+	return share
+}
+
+func (b *tokenBucket) release(share int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// setRate forgets the reservations
+	if b.reserved -= share; b.reserved < 0 {
+		b.reserved = 0
+	}
+}
+
+// effectiveLimit is the lower of two limits where 0 is unlimited
+func effectiveLimit(a, b int) int {
+	if a == 0 || b != 0 && b < a {
+		return b
+	}
+	return a
+}
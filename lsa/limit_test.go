@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Now()
+	b.spend(now, 10<<20)
+	if d := b.delay(now); d != 0 {
+		t.Fatalf("unlimited delay %v", d)
+	}
+
+	b.setRate(1024)
+	if d := b.delay(now); d != 0 {
+		t.Fatalf("fresh bucket delay %v", d)
+	}
+	b.spend(now, 2<<20)
+	if d := b.delay(now); d != 2*time.Second {
+		t.Fatalf("delay %v, want 2s", d)
+	}
+	if d := b.delay(now.Add(1500 * time.Millisecond)); d != 500*time.Millisecond {
+		t.Fatalf("delay %v, want 500ms", d)
+	}
+	// idle time gives at most a second of burst
+	now = now.Add(time.Minute)
+	if d := b.delay(now); d != 0 {
+		t.Fatalf("paid off delay %v", d)
+	}
+	b.spend(now, 3<<20)
+	if d := b.delay(now); d != 2*time.Second {
+		t.Fatalf("delay after burst %v, want 2s", d)
+	}
+
+	b.setRate(0)
+	if d := b.delay(now); d != 0 {
+		t.Fatalf("delay after unlimit %v", d)
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	var b tokenBucket
+	if share := b.reserve(); share != 0 {
+		t.Fatalf("unlimited share %d", share)
+	}
+	b.setRate(1024)
+	a, c := b.reserve(), b.reserve()
+	if a != 512 || c != 256 {
+		t.Fatalf("shares %d %d, want 512 256", a, c)
+	}
+	// sends get what the rsyncs left
+	now := time.Now()
+	b.delay(now)
+	b.spend(now, 512<<10)
+	if d := b.delay(now); d != 2*time.Second {
+		t.Fatalf("delay %v, want 2s", d)
+	}
+	b.release(a)
+	b.release(c)
+	if d := b.delay(now); d != 500*time.Millisecond {
+		t.Fatalf("delay after release %v, want 500ms", d)
+	}
+}
+
+func TestEffectiveLimit(t *testing.T) {
+	for _, c := range [][3]int{{0, 0, 0}, {100, 0, 100}, {0, 50, 50}, {100, 50, 50}, {50, 100, 50}} {
+		if got := effectiveLimit(c[0], c[1]); got != c[2] {
+			t.Errorf("effectiveLimit(%d, %d) = %d, want %d", c[0], c[1], got, c[2])
+		}
+	}
+}
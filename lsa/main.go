@@ -1,7 +1,7 @@
 package main
 
 import (
-	"eelf.ru/lsa"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,97 +9,18 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"strings"
-	"time"
+	"syscall"
 )
 
-var pref string
-var repo *Repository
-var eventLog EventLog
-
-func diff(dir string) error {
-	fis, err := ioutil.ReadDir(dir)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-
-		parent := path.Dir(dir)
-		base := path.Base(dir)
-
-		repo.DelFile(parent, base)
-
-		eventLog.Add([]Event{{dir: parent, name: base, isDelete: true}})
-
-		return nil
-	}
-
-	repo.AddDirIfNew(dir)
-	repoInfo := repo.GetDirStat(dir)
-
-	delDetection := make(map[string]bool)
-	for name := range repoInfo {
-		delDetection[name] = true
-	}
-
-	var events []Event
-
-	for _, fi := range fis {
-		delete(delDetection, fi.Name())
-		el, ok := repoInfo[fi.Name()]
-
-		newEl := lsa.NewStat(fi)
-		if !ok || el.Diff(newEl) {
-
-			if newEl.IsDir() {
-				log.Printf("dir appeared or changed %v -> %v", el, newEl)
-			}
-
-			repoInfo[fi.Name()] = newEl
-			events = append(events, Event{dir: dir, name: fi.Name()})
-
-			//special case: now it is dir but earlier it hasn't existed or wasn't a dir
-			if fi.IsDir() && (!ok || !el.IsDir()) {
-				err := itDir(
-					filepath.Join(dir, fi.Name()),
-					func(dir2 string, fi2 os.FileInfo) {
-
-						if fi2.IsDir() {
-							log.Printf("dirrecu after parent appeared or changed %v", lsa.NewStat(fi2))
-						}
-
-						repo.AddFileToDir(dir2, fi2.Name(), lsa.NewStat(fi2))
-						events = append(events, Event{dir: dir2, name: fi2.Name()})
-					},
-					func(dir2 string) {
-						repo.AddDirIfNew(dir2)
-					})
-				if err != nil {
-					return err
-				}
-			}
-		}
-	}
-	for name := range delDetection {
-		delete(repoInfo, name)
-		events = append(events, Event{dir: dir, name: name, isDelete: true})
-	}
-	repo.SetDirStat(dir, repoInfo)
-	if len(events) > 0 {
-		eventLog.Add(events)
-	}
-	return nil
-}
-
-func itDir(dir string, fileCb func(string, os.FileInfo), dirCb func(string)) error {
+func itDir(root, dir string, fileCb func(string, os.FileInfo), dirCb func(string)) error {
 	stack := []string{dir}
 	for len(stack) > 0 {
 		curDir := stack[len(stack)-1]
 		stack = stack[0 : len(stack)-1]
-		fis, err := ioutil.ReadDir(curDir)
+		fis, err := ioutil.ReadDir(filepath.Join(root, curDir))
 		if err != nil {
 			return err
 		}
@@ -114,118 +35,127 @@ func itDir(dir string, fileCb func(string, os.FileInfo), dirCb func(string)) err
 	return nil
 }
 
-func sshOptions() []string {
-	options := []string{
-		"-o", fmt.Sprint("ConnectTimeout=", 10),
-		"-o", "LogLevel=ERROR",
-		"-o", fmt.Sprint("ServerAliveInterval=", 3),
-		"-o", fmt.Sprint("ServerAliveCountMax=", 4),
-		//If set to yes, passphrase/password querying will be disabled. This option is useful in scripts and other batch jobs where no user is present to supply the password
-		"-o", "BatchMode=yes",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
+var Version string
+
+var configFile = flag.String("config", "", "json config with root and spaces, reread on SIGHUP or POST /reload")
+var bwlimit = flag.Int("bwlimit", 0, "KiB/s all the spaces may send together when the config sets none, 0 is unlimited")
+
+func readConfig() (conf *Config, err error) {
+	if len(*configFile) > 0 {
+		conf, err = LoadConfig(*configFile)
+	} else {
+		conf, err = ArgsConfig(flag.Args())
 	}
-	if false {
-		options = append(options, "-o", "Compression=yes")
+	if err == nil && conf.Bwlimit == 0 {
+		conf.Bwlimit = *bwlimit
 	}
-
-	return options
+	return
 }
 
-var Version string
+// global limit of the last config, a limit set at runtime stays until the config changes it
+var configBwlimit int
 
-func main() {
-	log.SetPrefix(fmt.Sprintf("% -10s", ""))
+func reload(projects projectSet) error {
+	conf, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if conf.Bwlimit != configBwlimit {
+		configBwlimit = conf.Bwlimit
+		projects.setGlobalLimit(conf.Bwlimit)
+	}
+	return projects.update(conf.Projects)
+}
 
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	log.Println(Version, "mem sys", fmtSize(int(m.Sys)), "alloc", fmtSize(int(m.Alloc)))
+// WatchEvent is a change reported by the watcher
+type WatchEvent struct {
+	Path string
+	// Path is a changed entry, only it needs a stat, otherwise the dir at Path changed
+	Entry bool
+	// the watcher dropped events, everything under Path has to be rescanned
+	Overflow bool
+}
 
-	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
-	}()
+var watchCh = make(chan WatchEvent, 10000)
+var watchedRoots = make(map[string]bool)
 
-	flag.Parse()
-	args := flag.Args()
-	if len(args) < 2 {
-		log.Fatalln("args needed")
+// watch starts the watcher for root once, it cannot be stopped so a root
+// removed and added back by reload keeps using the first one
+func watch(root string) {
+	if watchedRoots[root] {
+		return
 	}
+	watchedRoots[root] = true
+	Watch(root, watchCh)
+}
 
-	if err := os.Chdir(args[0]); err != nil {
-		log.Fatalln("cannot chdir", args[0], err)
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST needed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := ctlReload(context.Background(), nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	fmt.Fprintln(w, "reloaded")
+}
 
-	var err error
-	if pref, err = os.Getwd(); err != nil {
-		log.Fatalln("cannot get wd", err)
+func main() {
+	flag.Parse()
+	if _, ok := controlCommands[flag.Arg(0)]; ok {
+		cmd := flag.Arg(0)
+		// flags are allowed after the subcommand too
+		flag.CommandLine.Parse(flag.Args()[1:])
+		os.Exit(runControl(append([]string{cmd}, flag.Args()...)))
 	}
 
-	repo = NewRepository()
+	log.SetPrefix(fmt.Sprintf("% -10s", ""))
 
-	eventLog = NewEventLog()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	log.Println(Version, "mem sys", fmtSize(int(m.Sys)), "alloc", fmtSize(int(m.Alloc)))
 
-	ch := make(chan string, 10000)
-	Watch(pref, ch)
+	go func() {
+		log.Println(http.ListenAndServe("localhost:6060", nil))
+	}()
 
-	err = itDir(
-		".",
-		func(dir string, fi os.FileInfo) {
-			repo.AddFileToDir(dir, fi.Name(), lsa.NewStat(fi))
-		},
-		func(dir string) {
-			repo.AddDirIfNew(dir)
-		})
+	conf, err := readConfig()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	for _, s := range args[1:] {
-		sp, err := NewSpace(s)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		go sp.sender()
+	configBwlimit = conf.Bwlimit
+	globalLimit.setRate(conf.Bwlimit)
+	projects := make(projectSet)
+	if err = projects.update(conf.Projects); err != nil {
+		log.Fatalln(err)
 	}
 
-	duration := 400 * time.Millisecond
-	t := time.NewTimer(duration)
-	t.Stop()
-	batch := make(map[string]int)
-	orderedBatch := make([]string, 0)
+	if err = serveControl(*controlSocket); err != nil {
+		log.Fatalln("control socket:", err)
+	}
 
-	runtime.ReadMemStats(&m)
-	log.Println("repo ready. processing fs events sys:", fmtSize(int(m.Sys)), "alloc:", fmtSize(int(m.Alloc)))
+	http.HandleFunc("/reload", reloadHandler)
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			log.Println("reloading config")
+			if _, err := ctlReload(context.Background(), nil); err != nil {
+				log.Println("reload failed:", err)
+			}
+		}
+	}()
 
-	pathSeparator := fmt.Sprintf("%c", os.PathSeparator)
-	order := 0
 	for {
 		select {
-		case <-t.C:
-			order = 0
-			if cap(orderedBatch) < len(batch) {
-				orderedBatch = make([]string, len(batch))
-			}
-			orderedBatch = orderedBatch[0:len(batch)]
-			for dir, order := range batch {
-				orderedBatch[order] = dir
-			}
-			for _, dir := range orderedBatch {
-				err = diff(dir)
-				if err != nil {
-					log.Fatalln("diff err:", err)
-				}
-				delete(batch, dir)
-			}
-		case p := <-ch:
-			dir := strings.Trim(strings.TrimPrefix(p, pref), pathSeparator)
-			if len(dir) == 0 {
-				dir = "."
-			}
-			if _, ok := batch[dir]; !ok {
-				batch[dir] = order
-				order++
-			}
-			t.Reset(duration)
+		case ev := <-watchCh:
+			projects.route(ev)
+		case f := <-mainCalls:
+			f(projects)
 		}
 	}
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	res, err := ctlStatus(ctx, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(res)
+}
+
+type metric struct {
+	name, typ, help string
+	value           func(st *SpaceStatus) float64
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func timeMetric(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+var spaceMetrics = []metric{
+	{"lsa_space_connected", "gauge", "Whether the lsa-space session is up.", func(st *SpaceStatus) float64 { return boolMetric(!st.Since.IsZero()) }},
+	{"lsa_space_connected_since_seconds", "gauge", "Unix time the current session started, 0 when disconnected.", func(st *SpaceStatus) float64 { return timeMetric(st.Since) }},
+	{"lsa_space_paused", "gauge", "Whether the space is paused.", func(st *SpaceStatus) float64 { return boolMetric(st.Paused) }},
+	{"lsa_space_backlog_events", "gauge", "Events in the event log not yet taken by the sender.", func(st *SpaceStatus) float64 { return float64(st.Backlog) }},
+	{"lsa_space_acked_seq", "gauge", "Seq of the last event acknowledged by lsa-space.", func(st *SpaceStatus) float64 { return float64(st.Acked) }},
+	{"lsa_space_sent_bytes_total", "counter", "Bytes written to lsa-space.", func(st *SpaceStatus) float64 { return float64(st.BytesSent) }},
+	{"lsa_space_sent_files_total", "counter", "Files written or deleted on lsa-space.", func(st *SpaceStatus) float64 { return float64(st.FilesSent) }},
+	{"lsa_space_speed_bytes", "gauge", "Bytes written per second over the last 10s.", func(st *SpaceStatus) float64 { return float64(st.Speed) }},
+	{"lsa_space_frame_rate", "gauge", "Frames written per second over the last 10s.", func(st *SpaceStatus) float64 { return st.FrameRate }},
+	{"lsa_space_file_rate", "gauge", "Files written or deleted per second over the last 10s.", func(st *SpaceStatus) float64 { return st.FileRate }},
+	{"lsa_space_latency_seconds", "gauge", "Average time from a fs change to its ack by lsa-space over the last 10s.", func(st *SpaceStatus) float64 { return st.Latency.Seconds() }},
+	{"lsa_space_latency_max_seconds", "gauge", "Longest time from a fs change to its ack by lsa-space over the last 10s.", func(st *SpaceStatus) float64 { return st.LatencyMax.Seconds() }},
+	{"lsa_space_rtt_seconds", "gauge", "Average ping round trip over the last 10s.", func(st *SpaceStatus) float64 { return st.RTT.Seconds() }},
+	{"lsa_space_chunk_bytes", "gauge", "Current big file chunk size.", func(st *SpaceStatus) float64 { return float64(st.Chunk) }},
+	{"lsa_space_big_files", "gauge", "Big files being streamed.", func(st *SpaceStatus) float64 { return float64(st.BigFiles) }},
+	{"lsa_space_unbarriered_total", "counter", "Storms, big files and retried files synced outside of the barrier.", func(st *SpaceStatus) float64 { return float64(st.Unbarriered) }},
+	{"lsa_space_errors_total", "counter", "Sender errors.", func(st *SpaceStatus) float64 { return float64(st.Errors) }},
+	{"lsa_space_last_error_timestamp_seconds", "gauge", "Unix time of the last sender error, 0 if none.", func(st *SpaceStatus) float64 { return timeMetric(st.LastErrorTime) }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func spaceLabels(st *SpaceStatus) string {
+	return fmt.Sprintf(`project="%s",space="%s"`, labelEscaper.Replace(st.Project), labelEscaper.Replace(st.Name))
+}
+
+// metricsHandler writes space status in prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	res, err := ctlStatus(ctx, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sts := res.([]SpaceStatus)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+	for _, m := range spaceMetrics {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range sts {
+			fmt.Fprintf(b, "%s{%s} %g\n", m.name, spaceLabels(&sts[i]), m.value(&sts[i]))
+		}
+	}
+	fmt.Fprintf(b, "# HELP lsa_space_state Current sender state.\n# TYPE lsa_space_state gauge\n")
+	for i := range sts {
+		fmt.Fprintf(b, "lsa_space_state{%s,state=\"%s\"} 1\n", spaceLabels(&sts[i]), labelEscaper.Replace(sts[i].State))
+	}
+	groups := groupStatuses(sts)
+	for _, m := range groupMetrics {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range groups {
+			g := &groups[i]
+			fmt.Fprintf(b, "%s{project=\"%s\",group=\"%s\"} %g\n", m.name, labelEscaper.Replace(g.Project), labelEscaper.Replace(g.Name), m.value(g))
+		}
+	}
+
+	var pss []ProjectStatus
+	withProjects(func(ps projectSet) {
+		for _, p := range ps {
+			pss = append(pss, p.status())
+		}
+	})
+	for _, m := range projectMetrics {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range pss {
+			fmt.Fprintf(b, "%s{project=\"%s\"} %g\n", m.name, labelEscaper.Replace(pss[i].Root), m.value(&pss[i]))
+		}
+	}
+}
+
+type projectMetric struct {
+	name, typ, help string
+	value           func(st *ProjectStatus) float64
+}
+
+var projectMetrics = []projectMetric{
+	{"lsa_project_head_seq", "gauge", "Seq of the last event.", func(st *ProjectStatus) float64 { return float64(st.Head) }},
+	{"lsa_project_pending_dirs", "gauge", "Dirs waiting for diff.", func(st *ProjectStatus) float64 { return float64(st.PendingDirs) }},
+	{"lsa_project_diff_wait_seconds_sum", "counter", "Total time diffed dirs waited since their first change.", func(st *ProjectStatus) float64 { return st.WaitSum.Seconds() }},
+	{"lsa_project_diff_wait_seconds_count", "counter", "Diffed dirs.", func(st *ProjectStatus) float64 { return float64(st.DiffedDirs) }},
+	{"lsa_project_diff_last_wait_seconds", "gauge", "Longest wait in the last diff round.", func(st *ProjectStatus) float64 { return st.LastWait.Seconds() }},
+	{"lsa_project_bulk", "gauge", "1 while an event storm holds back per-file events.", func(st *ProjectStatus) float64 { return boolMetric(st.Bulk) }},
+	{"lsa_project_bulk_syncs_total", "counter", "Event storms synced in bulk.", func(st *ProjectStatus) float64 { return float64(st.BulkSyncs) }},
+	{"lsa_project_barrier_commits_total", "counter", "Rounds committed by every space together.", func(st *ProjectStatus) float64 { return float64(st.BarrierCommits) }},
+	{"lsa_project_barrier_aborts_total", "counter", "Rounds aborted as a space failed to stage them in time.", func(st *ProjectStatus) float64 { return float64(st.BarrierAborts) }},
+	{"lsa_project_errors_total", "counter", "Failed scans and diffs.", func(st *ProjectStatus) float64 { return float64(st.Errors) }},
+	{"lsa_project_last_error_timestamp_seconds", "gauge", "Unix time of the last failed scan or diff, 0 if none.", func(st *ProjectStatus) float64 { return timeMetric(st.LastErrorTime) }},
+}
+
+type groupMetric struct {
+	name, typ, help string
+	value           func(st *GroupStatus) float64
+}
+
+var groupMetrics = []groupMetric{
+	{"lsa_group_spaces", "gauge", "Spaces in the host group.", func(st *GroupStatus) float64 { return float64(st.Spaces) }},
+	{"lsa_group_connected", "gauge", "Spaces of the group with the lsa-space session up.", func(st *GroupStatus) float64 { return float64(st.Connected) }},
+	{"lsa_group_synced", "gauge", "Spaces of the group all synced.", func(st *GroupStatus) float64 { return float64(st.Synced) }},
+	{"lsa_group_paused", "gauge", "Paused spaces of the group.", func(st *GroupStatus) float64 { return float64(st.Paused) }},
+	{"lsa_group_backlog_events", "gauge", "Events not yet taken by the spaces of the group, summed.", func(st *GroupStatus) float64 { return float64(st.Backlog) }},
+	{"lsa_group_speed_bytes", "gauge", "Bytes written per second to the spaces of the group over the last 10s.", func(st *GroupStatus) float64 { return float64(st.Speed) }},
+	{"lsa_group_errors_total", "counter", "Sender errors of the spaces of the group.", func(st *GroupStatus) float64 { return float64(st.Errors) }},
+}
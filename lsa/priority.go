@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// PriorityConfig puts paths matching Glob into a class, higher classes are sent first.
+// A glob without a slash matches the base name, "**" matches any number of dirs
+type PriorityConfig struct {
+	Glob     string `json:"glob"`
+	Priority int    `json:"priority"`
+}
+
+// checkGlob reports a malformed glob
+func checkGlob(glob string) error {
+	for _, seg := range strings.Split(glob, "/") {
+		if seg == "**" {
+			continue
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globMatch matches the slash separated relative path against glob
+func globMatch(glob, name string) bool {
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// priorityOf returns the priority of the first class matching name, 0 if none does
+func priorityOf(classes []PriorityConfig, name string) int {
+	for _, c := range classes {
+		if globMatch(c.Glob, name) {
+			return c.Priority
+		}
+	}
+	return 0
+}
+
+// prioritize orders events by their class keeping the order within a class,
+// a dir gets the highest priority of its content so it still goes first
+func prioritize(classes []PriorityConfig, evs []Event) {
+	if len(classes) == 0 || len(evs) < 2 {
+		return
+	}
+	prio := make([]int, len(evs))
+	index := make(map[string]int, len(evs))
+	for i := range evs {
+		name := path.Join(evs[i].dir, evs[i].name)
+		prio[i] = priorityOf(classes, name)
+		if !evs[i].bulk {
+			index[name] = i
+		}
+	}
+	for i := range evs {
+		if evs[i].bulk {
+			continue
+		}
+		for dir := evs[i].dir; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+			if j, ok := index[dir]; ok && prio[j] < prio[i] {
+				prio[j] = prio[i]
+			}
+		}
+	}
+	sort.Stable(byPriority{evs, prio})
+}
+
+type byPriority struct {
+	evs  []Event
+	prio []int
+}
+
+func (s byPriority) Len() int           { return len(s.evs) }
+func (s byPriority) Less(i, j int) bool { return s.prio[i] > s.prio[j] }
+func (s byPriority) Swap(i, j int) {
+	s.evs[i], s.evs[j] = s.evs[j], s.evs[i]
+	s.prio[i], s.prio[j] = s.prio[j], s.prio[i]
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		glob, name string
+		match      bool
+	}{
+		{"*.php", "index.php", true},
+		{"*.php", "src/lib/a.php", true},
+		{"*.php", "a.php.bak", false},
+		{"assets/**", "assets/img/logo.png", true},
+		{"assets/**", "assets", true},
+		{"assets/**", "web/assets/logo.png", false},
+		{"**/assets/*.png", "web/assets/logo.png", true},
+		{"**/assets/*.png", "assets/logo.png", true},
+		{"**/assets/*.png", "web/assets/img/logo.png", false},
+		{"src/*/main.go", "src/cmd/main.go", true},
+		{"src/*/main.go", "src/main.go", false},
+		{"a/**/b/**/c", "a/x/b/y/z/c", true},
+		{"a/**/b/**/c", "a/b/c", true},
+		{"a/**/b/**/c", "a/x/c", false},
+	} {
+		if m := globMatch(c.glob, c.name); m != c.match {
+			t.Errorf("globMatch(%q, %q) = %t", c.glob, c.name, m)
+		}
+	}
+	if checkGlob("src/[a-/*.go") == nil {
+		t.Error("bad glob accepted")
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	classes := []PriorityConfig{
+		{Glob: "*.php", Priority: 10},
+		{Glob: "assets/**", Priority: -10},
+	}
+	evs := []Event{
+		{dir: "assets", name: "1.png"},
+		{dir: "assets", name: "2.png"},
+		{dir: ".", name: "README"},
+		{dir: ".", name: "new"},
+		{dir: "new", name: "deep"},
+		{dir: "new/deep", name: "page.php"},
+		{dir: "assets", name: "3.png"},
+		{dir: ".", name: "index.php"},
+	}
+	prioritize(classes, evs)
+	var order []string
+	for _, ev := range evs {
+		order = append(order, path.Join(ev.dir, ev.name))
+	}
+	want := []string{
+		// dirs of a php file go along with it
+		"new", "new/deep", "new/deep/page.php", "index.php",
+		"README",
+		"assets/1.png", "assets/2.png", "assets/3.png",
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order %v want %v", order, want)
+		}
+	}
+}
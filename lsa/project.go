@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"eelf.ru/lsa"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Project struct {
+	root     string
+	repo     *Repository
+	eventLog EventLog
+	stage    *contentStage
+	barrier  *barrier
+	spaces   spaceSet
+	ch       chan WatchEvent
+	// set when an event did not fit into ch, the whole root is diffed then
+	lost    int32
+	calls   chan func()
+	flushCh chan chan struct{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu   sync.Mutex
+	conf ProjectConfig
+	st   ProjectStatus
+}
+
+type ProjectStatus struct {
+	Root        string `json:"root"`
+	Head        uint64 `json:"head"`
+	PendingDirs int    `json:"pending_dirs"`
+	DiffedDirs  uint64 `json:"diffed_dirs"`
+	// how long diffed dirs waited since their first change
+	WaitSum  time.Duration `json:"wait_sum"`
+	LastWait time.Duration `json:"last_wait"`
+	// an event storm is going on, per-file events are held back
+	Bulk      bool      `json:"bulk"`
+	BulkSince time.Time `json:"bulk_since"`
+	BulkSyncs uint64    `json:"bulk_syncs"`
+	// rounds committed and aborted by the barrier
+	BarrierCommits uint64 `json:"barrier_commits"`
+	BarrierAborts  uint64 `json:"barrier_aborts"`
+	// scans and diffs failed, the dirs are diffed again later
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	Errors        uint64    `json:"errors"`
+}
+
+func NewProject(conf ProjectConfig) (*Project, error) {
+	root, err := filepath.EvalSymlinks(conf.Root)
+	if err != nil {
+		return nil, err
+	}
+	p := &Project{
+		conf:     conf,
+		root:     root,
+		repo:     NewRepository(),
+		eventLog: NewEventLog(),
+		barrier:  newBarrier(),
+		spaces:   make(spaceSet),
+		ch:       make(chan WatchEvent, 10000),
+		calls:    make(chan func()),
+		flushCh:  make(chan chan struct{}),
+	}
+	p.stage = newContentStage(&p.eventLog)
+	return p, nil
+}
+
+func (p *Project) String() string {
+	return p.root
+}
+
+func (p *Project) config() ProjectConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conf
+}
+
+func (p *Project) setConfig(conf ProjectConfig) {
+	p.mu.Lock()
+	p.conf = conf
+	p.mu.Unlock()
+	p.eventLog.SetLimit(conf.EventLogMemory)
+}
+
+func (p *Project) status() ProjectStatus {
+	p.mu.Lock()
+	st := p.st
+	p.mu.Unlock()
+	st.Root = p.root
+	st.Head = p.eventLog.Head()
+	st.BarrierCommits, st.BarrierAborts = p.barrier.stats()
+	return st
+}
+
+func (p *Project) setError(err error) {
+	p.mu.Lock()
+	p.st.LastError = err.Error()
+	p.st.LastErrorTime = time.Now()
+	p.st.Errors++
+	p.mu.Unlock()
+}
+
+// inStorm reports whether per-file events are held back by an event storm
+func (p *Project) inStorm() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.st.Bulk
+}
+
+// diff updates the repository with the dir contents and returns the changes,
+// with names set only those entries are looked at, on error the changes made
+// to the repository so far are returned as well
+func (p *Project) diff(dir string, names []string) ([]Event, error) {
+	var events []Event
+	if names != nil && p.repo.lookup(dir, false) != nil {
+		for _, name := range names {
+			fi, err := os.Lstat(filepath.Join(p.root, dir, name))
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return events, err
+				}
+				if _, ok := p.repo.Get(dir, name); ok {
+					p.repo.DelFile(dir, name)
+					events = append(events, Event{dir: dir, name: name, isDelete: true})
+				}
+				continue
+			}
+			if events, err = p.diffEntry(dir, fi, events); err != nil {
+				return events, err
+			}
+		}
+		return events, nil
+	}
+
+	fis, err := ioutil.ReadDir(filepath.Join(p.root, dir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return events, err
+		}
+
+		parent := path.Dir(dir)
+		base := path.Base(dir)
+
+		p.repo.DelFile(parent, base)
+
+		return []Event{{dir: parent, name: base, isDelete: true}}, nil
+	}
+
+	if events, err = p.addDirs(dir, events); err != nil {
+		return events, err
+	}
+	p.repo.AddDirIfNew(dir)
+
+	delDetection := make(map[string]bool)
+	for name := range p.repo.GetDirStat(dir) {
+		delDetection[name] = true
+	}
+
+	for _, fi := range fis {
+		delete(delDetection, fi.Name())
+		if events, err = p.diffEntry(dir, fi, events); err != nil {
+			return events, err
+		}
+	}
+	for name := range delDetection {
+		p.repo.DelFile(dir, name)
+		events = append(events, Event{dir: dir, name: name, isDelete: true})
+	}
+	return events, nil
+}
+
+// addDirs adds the levels of dir the repository does not know yet with their
+// own stats, so they go to the spaces before the contents of dir
+func (p *Project) addDirs(dir string, events []Event) ([]Event, error) {
+	if dir == "." {
+		return events, nil
+	}
+	parent, base := path.Dir(dir), path.Base(dir)
+	if st, ok := p.repo.Get(parent, base); ok && st.IsDir() {
+		return events, nil
+	}
+	events, err := p.addDirs(parent, events)
+	if err != nil {
+		return events, err
+	}
+	fi, err := os.Lstat(filepath.Join(p.root, dir))
+	if err != nil {
+		return events, err
+	}
+	p.repo.AddFileToDir(parent, base, lsa.NewStat(fi))
+	return append(events, Event{dir: parent, name: base}), nil
+}
+
+// diffEntry compares an existing entry of dir with the repository
+func (p *Project) diffEntry(dir string, fi os.FileInfo, events []Event) ([]Event, error) {
+	el, ok := p.repo.Get(dir, fi.Name())
+
+	newEl := lsa.NewStat(fi)
+	if ok && !el.Diff(newEl) {
+		return events, nil
+	}
+
+	if newEl.IsDir() {
+		log.Printf("dir appeared or changed %v -> %v", &el, newEl)
+	}
+
+	p.repo.AddFileToDir(dir, fi.Name(), newEl)
+	events = append(events, Event{dir: dir, name: fi.Name()})
+
+	//special case: now it is dir but earlier it hasn't existed or wasn't a dir
+	if fi.IsDir() && (!ok || !el.IsDir()) {
+		err := itDir(
+			p.root,
+			filepath.Join(dir, fi.Name()),
+			func(dir2 string, fi2 os.FileInfo) {
+
+				if fi2.IsDir() {
+					log.Printf("dirrecu after parent appeared or changed %v", lsa.NewStat(fi2))
+				}
+
+				p.repo.AddFileToDir(dir2, fi2.Name(), lsa.NewStat(fi2))
+				events = append(events, Event{dir: dir2, name: fi2.Name()})
+			},
+			func(dir2 string) {
+				p.repo.AddDirIfNew(dir2)
+			})
+		if err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
+
+func (p *Project) scan() error {
+	start := time.Now()
+	lastLog := start
+	dirs, files := 0, 0
+	err := itDirParallel(
+		p.root,
+		".",
+		p.config().scanWorkers(),
+		func(dir string, fi os.FileInfo) {
+			p.repo.AddFileToDir(dir, fi.Name(), lsa.NewStat(fi))
+			files++
+			if files%4096 == 0 && time.Since(lastLog) >= 5*time.Second {
+				lastLog = time.Now()
+				log.Println(p, "scanning:", dirs, "dirs", files, "files in", lastLog.Sub(start).Truncate(time.Second))
+			}
+		},
+		func(dir string) {
+			p.repo.AddDirIfNew(dir)
+			dirs++
+		})
+	if err != nil {
+		return err
+	}
+	p.repo.Compact()
+	log.Println(p, "scanned", dirs, "dirs", files, "files in", time.Since(start).Truncate(time.Millisecond))
+	return nil
+}
+
+// owns reports whether the watcher path belongs to the project
+func (p *Project) owns(watched string) bool {
+	return watched == p.root || strings.HasPrefix(watched, p.root+string(os.PathSeparator))
+}
+
+// do runs f in the project loop, so f can use the repository
+func (p *Project) do(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	select {
+	case p.calls <- func() { f(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// flush diffs the pending batch right away instead of waiting for the debounce
+func (p *Project) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case p.flushCh <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+func (p *Project) start() {
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	p.done = make(chan struct{})
+	go p.run(ctx)
+}
+
+func (p *Project) stop() {
+	p.cancel()
+	<-p.done
+	p.spaces.stopAll()
+}
+
+func (p *Project) run(ctx context.Context) {
+	defer close(p.done)
+
+	// the root was readable when the project was added, a failing scan is retried
+	for {
+		err := p.scan()
+		if err == nil {
+			break
+		}
+		log.Println(p, "scan failed:", err)
+		p.setError(err)
+		p.repo = NewRepository()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(scanRetry):
+		}
+	}
+
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	batch := newDirBatch(defaultDebounce, defaultMaxDelay)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	log.Println(p, "repo ready. processing fs events sys:", fmtSize(int(m.Sys)), "alloc:", fmtSize(int(m.Alloc)))
+
+	pathSeparator := fmt.Sprintf("%c", os.PathSeparator)
+	// when the timer is set to fire, zero if it is stopped
+	var timerAt time.Time
+	// non-nil while an event storm goes on
+	var st *storm
+	startStorm := func(reason string) {
+		now := time.Now()
+		st = &storm{since: now, last: now}
+		log.Println(p, "event storm,", reason+", switching to bulk mode")
+		p.mu.Lock()
+		p.st.Bulk = true
+		p.st.BulkSince = now
+		p.mu.Unlock()
+	}
+	endStorm := func() {
+		if st.changes > 0 {
+			p.eventLog.Add([]Event{{dir: st.dir, bulk: true, changed: st.since.UnixNano()}})
+		}
+		log.Println(p, "event storm settled after", time.Since(st.since).Truncate(time.Millisecond), "with", st.changes, "changes, bulk sync of", st.dir, "and back to incremental mode")
+		p.mu.Lock()
+		p.st.Bulk = false
+		p.st.BulkSince = time.Time{}
+		if st.changes > 0 {
+			p.st.BulkSyncs++
+		}
+		p.mu.Unlock()
+		st = nil
+	}
+	reschedule := func() {
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		timerAt = batch.next()
+		if timerAt.IsZero() && st != nil {
+			timerAt = st.last.Add(p.config().BulkSettle.Or(defaultBulkSettle))
+		}
+		if !timerAt.IsZero() {
+			t.Reset(time.Until(timerAt))
+		}
+	}
+	add := func(ev WatchEvent) {
+		dir := strings.Trim(strings.TrimPrefix(ev.Path, p.root), pathSeparator)
+		if len(dir) == 0 {
+			dir = "."
+		}
+		now := time.Now()
+		switch {
+		case ev.Overflow:
+			log.Println(p, "watcher dropped events, rescanning", dir)
+			p.repo.Walk(dir, func(parent, name string, st *lsa.Stat) {
+				if st.IsDir() {
+					batch.add(path.Join(parent, name), now)
+				}
+			})
+			batch.add(dir, now)
+		case ev.Entry && dir != ".":
+			batch.addEntry(path.Dir(dir), path.Base(dir), now)
+		default:
+			batch.add(dir, now)
+		}
+		if st != nil {
+			st.last = now
+		} else if threshold := p.config().bulkThreshold(); threshold > 0 && len(batch.dirs) >= threshold {
+			startStorm(fmt.Sprint(len(batch.dirs), " dirs pending"))
+		}
+	}
+	// events route dropped while ch was full
+	addLost := func() {
+		if atomic.SwapInt32(&p.lost, 0) != 0 {
+			log.Println(p, "events dropped while busy, rescanning")
+			add(WatchEvent{Path: p.root, Overflow: true})
+		}
+	}
+	diffBatch := func(all bool) {
+		conf := p.config()
+		batch.debounce = conf.Debounce.Or(defaultDebounce)
+		batch.maxDelay = conf.MaxDelay.Or(defaultMaxDelay)
+
+		takenAt := time.Now()
+		taken := batch.take(takenAt, all)
+		var waitSum, maxWait time.Duration
+		var events []Event
+		for _, d := range taken {
+			evs, err := p.diff(d.dir, d.names)
+			if err != nil {
+				// the changes found so far go out, the dir is diffed again a bit later
+				log.Println(p, "diff", d.dir, "failed:", err)
+				p.setError(err)
+				batch.add(d.dir, takenAt.Add(scanRetry))
+			}
+			changed := takenAt.Add(-d.waited).UnixNano()
+			for i := range evs {
+				evs[i].changed = changed
+			}
+			events = append(events, evs...)
+			waitSum += d.waited
+			if d.waited > maxWait {
+				maxWait = d.waited
+			}
+		}
+		if len(taken) > 0 {
+			p.mu.Lock()
+			p.st.DiffedDirs += uint64(len(taken))
+			p.st.WaitSum += waitSum
+			p.st.LastWait = maxWait
+			p.st.PendingDirs = len(batch.dirs)
+			p.mu.Unlock()
+			if maxWait >= batch.maxDelay {
+				log.Println(p, "diffed", len(taken), "dirs, changes waited up to", maxWait.Truncate(time.Millisecond), "under steady churn")
+			}
+		}
+
+		if threshold := conf.bulkThreshold(); st == nil && threshold > 0 && len(events) >= threshold {
+			startStorm(fmt.Sprint(len(events), " changes in one round"))
+		}
+		if st != nil {
+			now := time.Now()
+			for i := range events {
+				if i == 0 || events[i].dir != events[i-1].dir {
+					st.touch(events[i].dir, now)
+				}
+			}
+			st.changes += len(events)
+			// a flush ends the storm right away, so waiting covers the bulk sync
+			if len(batch.dirs) == 0 && (all || now.Sub(st.last) >= conf.BulkSettle.Or(defaultBulkSettle)) {
+				endStorm()
+			}
+		} else if len(events) > 0 {
+			p.eventLog.Add(events)
+		}
+		reschedule()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case f := <-p.calls:
+			f()
+		case <-t.C:
+			diffBatch(false)
+		case done := <-p.flushCh:
+			for len(p.ch) > 0 {
+				add(<-p.ch)
+			}
+			addLost()
+			diffBatch(true)
+			close(done)
+		case ev := <-p.ch:
+			add(ev)
+			addLost()
+			// the due time of a dir only grows, so the timer set earlier is never late
+			if timerAt.IsZero() {
+				reschedule()
+			}
+		}
+	}
+}
+
+type projectSet map[string]*Project
+
+// update starts projects for new roots, stops the ones which roots are gone
+// and updates spaces of the rest
+func (ps projectSet) update(confs []ProjectConfig) error {
+	want := make(map[string]ProjectConfig)
+	// a new root which cannot be read refuses the config before anything is changed
+	added := make(map[string]*Project)
+	for _, conf := range confs {
+		want[conf.Root] = conf
+		if _, ok := ps[conf.Root]; ok {
+			continue
+		}
+		p, err := NewProject(conf)
+		if err != nil {
+			return err
+		}
+		if _, err = ioutil.ReadDir(p.root); err != nil {
+			return err
+		}
+		added[conf.Root] = p
+	}
+	for root, p := range ps {
+		if _, ok := want[root]; !ok {
+			log.Println(p, "removing project")
+			p.stop()
+			delete(ps, root)
+		}
+	}
+	for root, conf := range want {
+		if p, ok := ps[root]; ok {
+			p.setConfig(conf)
+			if err := p.spaces.update(p, conf.Spaces); err != nil {
+				return err
+			}
+			continue
+		}
+		p := added[root]
+		log.Println(p, "adding project")
+		p.setConfig(conf)
+		ps[root] = p
+		watch(p.root)
+		p.start()
+		if err := p.spaces.update(p, conf.Spaces); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setGlobalLimit changes the limit shared by every space
+func (ps projectSet) setGlobalLimit(rate int) {
+	log.Println("global bandwidth limit", rate, "KiB/s")
+	globalLimit.setRate(rate)
+	for _, p := range ps {
+		for _, s := range p.spaces {
+			s.poke()
+		}
+	}
+}
+
+// route passes a watcher event to the innermost project it belongs to
+func (ps projectSet) route(ev WatchEvent) {
+	var owner *Project
+	for _, p := range ps {
+		if p.owns(ev.Path) && (owner == nil || len(p.root) > len(owner.root)) {
+			owner = p
+		}
+	}
+	if owner == nil {
+		return
+	}
+	select {
+	case owner.ch <- ev:
+	default:
+		// a project busy scanning must not stall the others, it rescans once it
+		// gets to the events
+		atomic.StoreInt32(&owner.lost, 1)
+	}
+}
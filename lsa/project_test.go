@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestRouteBusyProject(t *testing.T) {
+	busy := &Project{root: "/p", ch: make(chan WatchEvent, 1)}
+	other := &Project{root: "/p/inner", ch: make(chan WatchEvent, 1)}
+	ps := projectSet{busy.root: busy, other.root: other}
+
+	ps.route(WatchEvent{Path: "/p/a"})
+	// nobody takes the events of busy, other still gets its own
+	ps.route(WatchEvent{Path: "/p/b"})
+	ps.route(WatchEvent{Path: "/p/inner/c"})
+	if ev := <-other.ch; ev.Path != "/p/inner/c" {
+		t.Fatalf("inner got %s", ev.Path)
+	}
+	if busy.lost == 0 || other.lost != 0 {
+		t.Fatalf("lost %d %d, want only the busy one", busy.lost, other.lost)
+	}
+	if ev := <-busy.ch; ev.Path != "/p/a" {
+		t.Fatalf("busy got %s", ev.Path)
+	}
+}
@@ -2,39 +2,259 @@ package main
 
 import (
 	"eelf.ru/lsa"
+	"sort"
+	"strings"
 )
 
-type Repository map[string]map[string]*lsa.Stat
+// Repository is the tree of known stats, dirs are nodes with entries sorted by name,
+// names are interned and stats are kept inline
+type Repository struct {
+	root repoDir
+
+	// interned names, an entry refers to its name by index
+	names []string
+	ids   map[string]uint32
+	refs  []uint32
+	free  []uint32
+}
+
+type repoDir struct {
+	entries []repoEntry
+	// contents of dir entries, only dirs already added are here
+	subs map[uint32]*repoDir
+}
+
+type repoEntry struct {
+	name uint32
+	stat lsa.Stat
+}
 
 func NewRepository() *Repository {
-	r := make(Repository)
-	return &r
+	return &Repository{ids: make(map[string]uint32)}
 }
 
-func (r *Repository) AddDirIfNew(dir string) {
-	if _, ok := (*r)[dir]; ok {
+func (r *Repository) intern(name string) uint32 {
+	if id, ok := r.ids[name]; ok {
+		r.refs[id]++
+		return id
+	}
+	// name may be a part of a longer path
+	name = string([]byte(name))
+	var id uint32
+	if n := len(r.free); n > 0 {
+		id = r.free[n-1]
+		r.free = r.free[:n-1]
+		r.names[id] = name
+		r.refs[id] = 1
+	} else {
+		id = uint32(len(r.names))
+		r.names = append(r.names, name)
+		r.refs = append(r.refs, 1)
+	}
+	r.ids[name] = id
+	return id
+}
+
+func (r *Repository) release(id uint32) {
+	if r.refs[id]--; r.refs[id] == 0 {
+		delete(r.ids, r.names[id])
+		r.names[id] = ""
+		r.free = append(r.free, id)
+	}
+}
+
+// releaseDir forgets the names of the whole subtree
+func (r *Repository) releaseDir(d *repoDir) {
+	if d == nil {
 		return
 	}
-	(*r)[dir] = make(map[string]*lsa.Stat)
+	for _, e := range d.entries {
+		r.release(e.name)
+		r.releaseDir(d.subs[e.name])
+	}
+}
+
+// remove drops the i-th entry of d together with its contents
+func (r *Repository) remove(d *repoDir, i int) {
+	id := d.entries[i].name
+	r.releaseDir(d.subs[id])
+	delete(d.subs, id)
+	r.release(id)
+	copy(d.entries[i:], d.entries[i+1:])
+	d.entries = d.entries[:len(d.entries)-1]
+}
+
+// find returns the index of name in d or where it should be inserted
+func (r *Repository) find(d *repoDir, name string) (int, bool) {
+	n := len(d.entries)
+	// entries mostly come sorted from ReadDir
+	if n > 0 && r.names[d.entries[n-1].name] < name {
+		return n, false
+	}
+	i := sort.Search(n, func(i int) bool { return r.names[d.entries[i].name] >= name })
+	return i, i < n && r.names[d.entries[i].name] == name
+}
+
+func (r *Repository) insert(d *repoDir, i int, name string, stat *lsa.Stat) {
+	d.entries = append(d.entries, repoEntry{})
+	copy(d.entries[i+1:], d.entries[i:])
+	d.entries[i] = repoEntry{r.intern(name), *stat}
+}
+
+// lookup returns the node of dir, with create it adds missing dirs on the way,
+// nil when a part of dir is known as a file
+func (r *Repository) lookup(dir string, create bool) *repoDir {
+	d := &r.root
+	if dir == "." || dir == "" {
+		return d
+	}
+	for len(dir) > 0 {
+		name := dir
+		if i := strings.IndexByte(dir, '/'); i >= 0 {
+			name, dir = dir[:i], dir[i+1:]
+		} else {
+			dir = ""
+		}
+		i, ok := r.find(d, name)
+		if !ok {
+			if !create {
+				return nil
+			}
+			r.insert(d, i, name, dirStat)
+		} else if !d.entries[i].stat.IsDir() {
+			return nil
+		}
+		id := d.entries[i].name
+		sub := d.subs[id]
+		if sub == nil {
+			if !create {
+				return nil
+			}
+			if d.subs == nil {
+				d.subs = make(map[uint32]*repoDir)
+			}
+			sub = &repoDir{}
+			d.subs[id] = sub
+		}
+		d = sub
+	}
+	return d
+}
+
+// dirStat stands for dirs added before their own stat is known
+var dirStat = lsa.NewDirStat()
+
+func (r *Repository) AddDirIfNew(dir string) {
+	r.lookup(dir, true)
 }
 
 func (r *Repository) AddFileToDir(dir, file string, stat *lsa.Stat) {
-	(*r)[dir][file] = stat
+	d := r.lookup(dir, true)
+	if d == nil {
+		return
+	}
+	i, ok := r.find(d, file)
+	if !ok {
+		r.insert(d, i, file, stat)
+		return
+	}
+	e := &d.entries[i]
+	e.stat = *stat
+	if !stat.IsDir() && d.subs[e.name] != nil {
+		r.releaseDir(d.subs[e.name])
+		delete(d.subs, e.name)
+	}
 }
 
-func (r *Repository) GetDirStat(dir string) map[string]*lsa.Stat {
-	stat, ok := (*r)[dir]
+// Get returns the stat of a single entry
+func (r *Repository) Get(dir, file string) (lsa.Stat, bool) {
+	d := r.lookup(dir, false)
+	if d == nil {
+		return lsa.Stat{}, false
+	}
+	i, ok := r.find(d, file)
 	if !ok {
-		return nil
+		return lsa.Stat{}, false
 	}
+	return d.entries[i].stat, true
+}
 
+// GetDirStat returns a copy of the dir entries, nil if the dir is unknown
+func (r *Repository) GetDirStat(dir string) map[string]lsa.Stat {
+	d := r.lookup(dir, false)
+	if d == nil {
+		return nil
+	}
+	stat := make(map[string]lsa.Stat, len(d.entries))
+	for _, e := range d.entries {
+		stat[r.names[e.name]] = e.stat
+	}
 	return stat
 }
 
-func (r *Repository) SetDirStat(dir string, stat map[string]*lsa.Stat) {
-	(*r)[dir] = stat
+// SetDirStat replaces the dir entries, contents of dirs which stay dirs are kept
+func (r *Repository) SetDirStat(dir string, stat map[string]lsa.Stat) {
+	d := r.lookup(dir, true)
+	if d == nil {
+		return
+	}
+	for i := len(d.entries) - 1; i >= 0; i-- {
+		if _, ok := stat[r.names[d.entries[i].name]]; !ok {
+			r.remove(d, i)
+		}
+	}
+	for name, st := range stat {
+		st := st
+		r.AddFileToDir(dir, name, &st)
+	}
 }
 
+// DelFile removes the entry together with its contents
 func (r *Repository) DelFile(dir, file string) {
-	delete((*r)[dir], file)
+	d := r.lookup(dir, false)
+	if d == nil {
+		return
+	}
+	if i, ok := r.find(d, file); ok {
+		r.remove(d, i)
+	}
+}
+
+// Walk calls fn for every entry under dir, a dir goes before its contents
+func (r *Repository) Walk(dir string, fn func(dir, name string, stat *lsa.Stat)) {
+	d := r.lookup(dir, false)
+	if d == nil {
+		return
+	}
+	r.walk(dir, d, fn)
+}
+
+func (r *Repository) walk(dir string, d *repoDir, fn func(dir, name string, stat *lsa.Stat)) {
+	for i := range d.entries {
+		e := &d.entries[i]
+		name := r.names[e.name]
+		fn(dir, name, &e.stat)
+		if sub := d.subs[e.name]; sub != nil {
+			if dir != "." {
+				name = dir + "/" + name
+			}
+			r.walk(name, sub, fn)
+		}
+	}
+}
+
+// Compact gives back the spare capacity left by growing entry slices
+func (r *Repository) Compact() {
+	r.compact(&r.root)
+}
+
+func (r *Repository) compact(d *repoDir) {
+	if cap(d.entries) > len(d.entries) {
+		entries := make([]repoEntry, len(d.entries))
+		copy(entries, d.entries)
+		d.entries = entries
+	}
+	for _, sub := range d.subs {
+		r.compact(sub)
+	}
 }
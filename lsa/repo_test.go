@@ -0,0 +1,157 @@
+package main
+
+import (
+	"eelf.ru/lsa"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type testFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi testFileInfo) Name() string       { return fi.name }
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) ModTime() time.Time { return time.Unix(1500000000, 0) }
+func (fi testFileInfo) IsDir() bool        { return fi.isDir }
+func (fi testFileInfo) Sys() interface{}   { return nil }
+func (fi testFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func fileStat(name string, size int64) *lsa.Stat {
+	return lsa.NewStat(testFileInfo{name: name, size: size})
+}
+
+func dirStatOf(name string) *lsa.Stat {
+	return lsa.NewStat(testFileInfo{name: name, isDir: true})
+}
+
+func TestRepository(t *testing.T) {
+	r := NewRepository()
+	r.AddDirIfNew(".")
+	r.AddFileToDir(".", "b", fileStat("b", 1))
+	r.AddFileToDir(".", "a", dirStatOf("a"))
+	r.AddDirIfNew("a")
+	r.AddFileToDir("a", "x", fileStat("x", 2))
+	r.AddFileToDir("a", "sub", dirStatOf("sub"))
+	r.AddFileToDir("a/sub", "y", fileStat("y", 3))
+
+	if st, ok := r.Get("a/sub", "y"); !ok || st.Size() != 3 {
+		t.Fatalf("a/sub/y %v %t", &st, ok)
+	}
+	var walked []string
+	r.Walk(".", func(dir, name string, st *lsa.Stat) {
+		walked = append(walked, path.Join(dir, name))
+	})
+	if fmt.Sprint(walked) != "[a a/sub a/sub/y a/x b]" {
+		t.Fatalf("walked %v", walked)
+	}
+
+	// a dir which stays a dir keeps its contents
+	stat := r.GetDirStat("a")
+	delete(stat, "x")
+	stat["z"] = *fileStat("z", 4)
+	r.SetDirStat("a", stat)
+	if _, ok := r.Get("a/sub", "y"); !ok {
+		t.Fatal("a/sub lost its contents")
+	}
+	if _, ok := r.Get("a", "x"); ok {
+		t.Fatal("a/x is kept")
+	}
+
+	// a dir turned into a file drops its contents
+	r.AddFileToDir("a", "sub", fileStat("sub", 5))
+	if r.GetDirStat("a/sub") != nil {
+		t.Fatal("a/sub contents kept for a file")
+	}
+	// nothing goes under a file
+	r.AddFileToDir("a/sub", "w", fileStat("w", 6))
+	if _, ok := r.Get("a/sub", "w"); ok {
+		t.Fatal("a/sub/w added under a file")
+	}
+	if st, _ := r.Get("a", "sub"); st.IsDir() {
+		t.Fatal("a/sub turned into a dir")
+	}
+
+	r.DelFile(".", "a")
+	if r.GetDirStat("a") != nil {
+		t.Fatal("a is kept")
+	}
+	if len(r.ids) != 1 || len(r.free) != len(r.names)-1 {
+		t.Fatalf("interned names %v, want only b", r.ids)
+	}
+}
+
+// buildTree fills a tree of dirs*dirs dirs with files each, names repeat across dirs like in real trees
+func buildTree(add func(dir, name string, st *lsa.Stat), dirs, files int) {
+	for i := 0; i < dirs; i++ {
+		top := fmt.Sprint("module", i)
+		add(".", top, dirStatOf(top))
+		for j := 0; j < dirs; j++ {
+			sub := fmt.Sprint("src", j)
+			add(top, sub, dirStatOf(sub))
+			for k := 0; k < files; k++ {
+				name := fmt.Sprint("file", k, ".js")
+				add(top+"/"+sub, name, fileStat(name, int64(k)))
+			}
+		}
+	}
+}
+
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+func benchmarkTreeMemory(b *testing.B, build func() interface{}) {
+	const dirs, files = 30, 100
+	entries := dirs + dirs*dirs + dirs*dirs*files
+	b.ReportAllocs()
+	var kept interface{}
+	for i := 0; i < b.N; i++ {
+		before := heapAlloc()
+		kept = build()
+		after := heapAlloc()
+		if i == 0 {
+			b.Logf("%d bytes per entry", int(after-before)/entries)
+		}
+	}
+	runtime.KeepAlive(kept)
+}
+
+func BenchmarkRepositoryMemory(b *testing.B) {
+	benchmarkTreeMemory(b, func() interface{} {
+		r := NewRepository()
+		buildTree(func(dir, name string, st *lsa.Stat) {
+			r.AddFileToDir(dir, name, st)
+		}, 30, 100)
+		r.Compact()
+		return r
+	})
+}
+
+// BenchmarkMapRepositoryMemory is the former layout with full dir keys and a Stat per file on the heap
+func BenchmarkMapRepositoryMemory(b *testing.B) {
+	benchmarkTreeMemory(b, func() interface{} {
+		r := make(map[string]map[string]*lsa.Stat)
+		buildTree(func(dir, name string, st *lsa.Stat) {
+			if r[dir] == nil {
+				r[dir] = make(map[string]*lsa.Stat)
+			}
+			r[dir][name] = st
+		}, 30, 100)
+		return r
+	})
+}
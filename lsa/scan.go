@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultScanWorkers = 16
+
+// how long a project waits before scanning again after a failed scan
+const scanRetry = 10 * time.Second
+
+type dirListing struct {
+	dir string
+	fis []os.FileInfo
+	err error
+}
+
+// itDirParallel walks like itDir but reads dirs with a pool of workers,
+// the callbacks are still called from the calling goroutine one at a time
+func itDirParallel(root, dir string, workers int, fileCb func(string, os.FileInfo), dirCb func(string)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	results := make(chan dirListing, workers)
+	done := make(chan struct{})
+	defer close(done)
+	defer close(jobs)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for dir := range jobs {
+				fis, err := ioutil.ReadDir(filepath.Join(root, dir))
+				select {
+				case results <- dirListing{dir, fis, err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	queue := []string{dir}
+	inFlight := 0
+	for len(queue) > 0 || inFlight > 0 {
+		var send chan string
+		var next string
+		if len(queue) > 0 {
+			send = jobs
+			next = queue[len(queue)-1]
+		}
+		select {
+		case send <- next:
+			queue = queue[:len(queue)-1]
+			inFlight++
+		case res := <-results:
+			inFlight--
+			if res.err != nil {
+				return res.err
+			}
+			dirCb(res.dir)
+			for _, fi := range res.fis {
+				fileCb(res.dir, fi)
+				if fi.IsDir() {
+					queue = append(queue, filepath.Join(res.dir, fi.Name()))
+				}
+			}
+		}
+	}
+	return nil
+}
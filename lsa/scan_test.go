@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func scanResult(t *testing.T, walk func(fileCb func(string, os.FileInfo), dirCb func(string)) error) (map[string]bool, map[string]string) {
+	dirs := make(map[string]bool)
+	files := make(map[string]string)
+	err := walk(
+		func(dir string, fi os.FileInfo) {
+			if !dirs[dir] {
+				t.Fatalf("%s reported before its dir", fi.Name())
+			}
+			files[filepath.Join(dir, fi.Name())] = fmt.Sprint(fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+		},
+		func(dir string) {
+			dirs[dir] = true
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirs, files
+}
+
+func TestItDirParallel(t *testing.T) {
+	root, err := ioutil.TempDir("", "lsa-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for i := 0; i < 20; i++ {
+		dir := filepath.Join(root, fmt.Sprint("d", i%4), fmt.Sprint("sub", i))
+		if err := os.MkdirAll(filepath.Join(dir, "deep", "er"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 30; j++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint("f", j)), make([]byte, j), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("f1", filepath.Join(dir, "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	seqDirs, seqFiles := scanResult(t, func(fileCb func(string, os.FileInfo), dirCb func(string)) error {
+		return itDir(root, ".", fileCb, dirCb)
+	})
+	for _, workers := range []int{1, 3, 16} {
+		dirs, files := scanResult(t, func(fileCb func(string, os.FileInfo), dirCb func(string)) error {
+			return itDirParallel(root, ".", workers, fileCb, dirCb)
+		})
+		if !reflect.DeepEqual(dirs, seqDirs) {
+			t.Fatalf("%d workers: dirs %v want %v", workers, dirs, seqDirs)
+		}
+		if !reflect.DeepEqual(files, seqFiles) {
+			t.Fatalf("%d workers: %d files differ from %d sequential", workers, len(files), len(seqFiles))
+		}
+	}
+
+	if err := itDirParallel(filepath.Join(root, "missing"), ".", 4, func(string, os.FileInfo) {}, func(string) {}); err == nil {
+		t.Fatal("missing root scanned")
+	}
+}
@@ -1,35 +1,112 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"eelf.ru/lsa"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Space struct {
 	host, dir, user, sudo string
-	speedBytes uint
-	speedTime time.Duration
+
+	project *Project
+	conf    SpaceConfig
+	limit   tokenBucket
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu       sync.Mutex
+	st       SpaceStatus
+	wake     chan struct{}
+	resyncCh chan string
+	// seqs that become acked when lsa-space answers the pings in flight
+	pings []sentPing
+	ackCh chan struct{}
+
+	// sliding windows of what was written and how long changes took to be acked
+	bytesWin, framesWin, filesWin, latencyWin, rttWin window
+	// taken events waiting for the ack, for the latency
+	unacked []sentEvent
+}
+
+type sentPing struct {
+	seq uint64
+	at  time.Time
+}
+
+type sentEvent struct {
+	seq     uint64
+	changed int64
+}
+
+type SpaceStatus struct {
+	Name    string    `json:"name"`
+	Project string    `json:"project"`
+	Group   string    `json:"group,omitempty"`
+	State   string    `json:"state"`
+	Paused  bool      `json:"paused"`
+	Since   time.Time `json:"since"`
+	Backlog int       `json:"backlog"`
+	Acked   uint64    `json:"acked"`
+	// bytes, frames and files per second over the last windowSecs
+	Speed     uint    `json:"speed"`
+	FrameRate float64 `json:"frame_rate"`
+	FileRate  float64 `json:"file_rate"`
+	// from the fs change to the ack of lsa-space, over the last windowSecs
+	Latency    time.Duration `json:"latency"`
+	LatencyMax time.Duration `json:"latency_max"`
+	BytesSent  uint64        `json:"bytes_sent"`
+	FilesSent  uint64        `json:"files_sent"`
+	BigFiles   int           `json:"big_files"`
+	// storms, big files and retried files synced outside of the barrier in barrier mode
+	Unbarriered uint64 `json:"unbarriered"`
+	// ping round trip over the last windowSecs and the current big file chunk size
+	RTT   time.Duration `json:"rtt"`
+	Chunk int           `json:"chunk"`
+	// KiB/s, the lower of the space and global limits, 0 is unlimited
+	Limit         int       `json:"limit"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	Errors        uint64    `json:"errors"`
 }
 
-const bigSize = 2 << 20
+// limits of a batch of small writes and deletes
+const (
+	batchFiles = 1024
+	batchBytes = 1 << 20
+)
+
+// how long a file being changed waits before it is read again
+const changingRetry = 500 * time.Millisecond
 
-func NewSpace(arg string) (s Space, err error) {
+func NewSpace(p *Project, conf SpaceConfig) (s *Space, err error) {
+	arg := conf.Spec
 	parts := strings.Split(arg, ":")
 	if len(parts) != 2 {
 		err = fmt.Errorf("bad host:dir spec: %s", arg)
 		return
 	}
+	s = &Space{
+		project:  p,
+		conf:     conf,
+		wake:     make(chan struct{}, 1),
+		resyncCh: make(chan string, 16),
+		ackCh:    make(chan struct{}),
+	}
+	s.limit.setRate(conf.Bwlimit)
 	s.host = parts[0]
 	s.dir = parts[1]
 	if hostUserParts := strings.Split(parts[0], "@"); len(hostUserParts) == 2 {
@@ -39,9 +116,210 @@ func NewSpace(arg string) (s Space, err error) {
 	return
 }
 
-func execCommand(name string, arg ...string) *exec.Cmd {
+func (s *Space) String() string {
+	return s.conf.Spec
+}
+
+func (s *Space) hostUser() string {
+	if len(s.user) > 0 {
+		return s.user + "@" + s.host
+	}
+	return s.host
+}
+
+func (s *Space) status() SpaceStatus {
+	s.mu.Lock()
+	st := s.st
+	now := time.Now()
+	st.Speed = uint(s.bytesWin.rate(now))
+	st.FrameRate = s.framesWin.rate(now)
+	st.FileRate = s.filesWin.rate(now)
+	avg, max := s.latencyWin.avg(now)
+	st.Latency = time.Duration(avg * float64(time.Second))
+	st.LatencyMax = time.Duration(max * float64(time.Second))
+	rtt, _ := s.rttWin.avg(now)
+	st.RTT = time.Duration(rtt * float64(time.Second))
+	s.mu.Unlock()
+	st.Name = s.String()
+	st.Project = s.project.root
+	st.Group = s.conf.Group
+	st.Backlog = s.project.eventLog.Pending(s.String())
+	st.Limit = s.bwlimit()
+	return st
+}
+
+// setLimit changes the space limit at runtime, a running rsync keeps the old one
+func (s *Space) setLimit(rate int) {
+	s.limit.setRate(rate)
+	s.poke()
+}
+
+func (s *Space) bwlimit() int {
+	return effectiveLimit(s.limit.limit(), globalLimit.limit())
+}
+
+// throttle returns how long big files have to wait for the space and global limits
+func (s *Space) throttle(now time.Time) time.Duration {
+	d := s.limit.delay(now)
+	if g := globalLimit.delay(now); g > d {
+		d = g
+	}
+	return d
+}
+
+func (s *Space) unbarriered() {
+	s.mu.Lock()
+	s.st.Unbarriered++
+	s.mu.Unlock()
+}
+
+func (s *Space) setState(state string) {
+	s.mu.Lock()
+	s.st.State = state
+	s.mu.Unlock()
+}
+
+func (s *Space) setError(err error) {
+	s.mu.Lock()
+	s.st.LastError = err.Error()
+	s.st.LastErrorTime = time.Now()
+	s.st.Errors++
+	s.mu.Unlock()
+}
+
+func (s *Space) setPaused(paused bool) {
+	s.mu.Lock()
+	s.st.Paused = paused
+	s.mu.Unlock()
+	s.poke()
+}
+
+func (s *Space) paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.Paused
+}
+
+// resync asks the sender to rsync path (relative to the project root) again
+func (s *Space) resync(path string) error {
+	select {
+	case s.resyncCh <- path:
+	default:
+		return fmt.Errorf("%s: too many resyncs pending", s)
+	}
+	s.poke()
+	return nil
+}
+
+func (s *Space) setAcked(seq uint64) {
+	s.mu.Lock()
+	if seq > s.st.Acked {
+		s.st.Acked = seq
+		close(s.ackCh)
+		s.ackCh = make(chan struct{})
+	}
+	now := time.Now()
+	unacked := s.unacked[:0]
+	for _, se := range s.unacked {
+		if se.seq > seq {
+			unacked = append(unacked, se)
+			continue
+		}
+		s.latencyWin.add(now, now.Sub(time.Unix(0, se.changed)).Seconds())
+	}
+	s.unacked = unacked
+	s.mu.Unlock()
+}
+
+// taken remembers when the changes of evs happened, their latency is known once they are acked
+func (s *Space) taken(evs []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ev := range evs {
+		if ev.changed != 0 {
+			s.unacked = append(s.unacked, sentEvent{ev.seq, ev.changed})
+		}
+	}
+}
+
+// rates formats the sliding window figures for logs
+func (s *Space) rates() string {
+	st := s.status()
+	return fmt.Sprintf("%sps %.1f frames/s %.1f files/s latency %v (max %v) rtt %v", fmtSize(int(st.Speed)), st.FrameRate, st.FileRate,
+		st.Latency.Truncate(time.Millisecond), st.LatencyMax.Truncate(time.Millisecond), st.RTT.Truncate(time.Millisecond))
+}
+
+// pingsInFlight returns the number of pings not answered yet
+func (s *Space) pingsInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pings)
+}
+
+// nextChunk returns the size of the next big file chunk, adapting the current one when asked to
+func (s *Space) nextChunk(conf ProjectConfig, lastSpeed float64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !conf.AdaptiveChunks || s.st.Chunk == 0 {
+		s.st.Chunk = conf.chunkSize()
+	} else {
+		rtt, _ := s.rttWin.avg(time.Now())
+		s.st.Chunk = adaptChunk(s.st.Chunk, lastSpeed, time.Duration(rtt*float64(time.Second)))
+	}
+	return s.st.Chunk
+}
+
+func (s *Space) pong() {
+	s.mu.Lock()
+	if len(s.pings) == 0 {
+		s.mu.Unlock()
+		log.Println(s.host, "unexpected ping reply")
+		return
+	}
+	p := s.pings[0]
+	s.pings = s.pings[1:]
+	now := time.Now()
+	s.rttWin.add(now, now.Sub(p.at).Seconds())
+	s.mu.Unlock()
+	s.setAcked(p.seq)
+}
+
+// ping sends a ping which reply acknowledges every event up to seq
+func (s *Space) ping(stdin io.WriteCloser, buf []byte, seq uint64) error {
+	s.mu.Lock()
+	s.pings = append(s.pings, sentPing{seq, time.Now()})
+	s.mu.Unlock()
+	rEv := lsa.Revent{Typ: lsa.TPing}
+	return s.write(stdin, buf, &rEv)
+}
+
+// waitAcked blocks until lsa-space has applied every event up to seq
+func (s *Space) waitAcked(ctx context.Context, seq uint64) error {
+	for {
+		s.mu.Lock()
+		acked, ch := s.st.Acked, s.ackCh
+		s.mu.Unlock()
+		if acked >= seq {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return fmt.Errorf("%s: acked %d of %d: %v", s, acked, seq, ctx.Err())
+		}
+	}
+}
+
+func (s *Space) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func execCommand(ctx context.Context, name string, arg ...string) *exec.Cmd {
 	log.Println(name, arg)
-	return exec.Command(name, arg...)
+	return exec.CommandContext(ctx, name, arg...)
 }
 
 func fmtSize(size int) string {
@@ -55,53 +333,163 @@ func fmtSize(size int) string {
 }
 
 type bigFile struct {
-	*os.File
 	*lsa.Stat
+	// the version streamed
+	fi  os.FileInfo
+	ev  Event
+	seq uint64
+	// bytes already sent
+	off int64
+	// the first chunk is sent, lsa-space has a temp file for it
+	started bool
 }
 
-func (s Space) senderOne() error {
-	eventLog.AddClient(s.host)
-	defer eventLog.RemoveClient(s.host)
-	hostUser := s.host
-	if len(s.user) > 0 {
-		hostUser = s.user + "@" + hostUser
-	}
+var rsyncStatRe = regexp.MustCompile("Number of files: (\\d+)\\s+Number of files transferred: (\\d+)\\s+Total file size: (\\d+) bytes\\s+Total transferred file size: (\\d+) bytes")
 
-	args := []string{"-e", "ssh " + strings.Join(sshOptions(), " ")}
-	args = append(args, "-az", "--delete", "--stats", "./", hostUser+":"+s.dir+"/")
+// rsync syncs path relative to the project root, "." means the whole project
+func (s *Space) rsync(ctx context.Context, path string) error {
+	// a vanished path is synced by its parent, so the remote copy is deleted as well
+	for path != "." {
+		if _, err := os.Lstat(filepath.Join(s.project.root, path)); !os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	dir, args := lsa.RsyncArgs(s.dir, s.conf.Releases > 0)
+	// rsyncs and streams of all the spaces share the global limit
+	share := globalLimit.reserve()
+	defer globalLimit.release(share)
+	if limit := effectiveLimit(s.limit.limit(), share); limit > 0 {
+		args = append(args, fmt.Sprint("--bwlimit=", limit))
+	}
+	if path == "." {
+		args = append(args, "-az", "--delete", "--stats", "./", s.hostUser()+":"+dir+"/")
+	} else {
+		args = append(args, "-azR", "--delete", "--stats", path, s.hostUser()+":"+dir+"/")
+	}
 
-	command := execCommand("rsync", args...)
+	command := execCommand(ctx, "rsync", args...)
+	command.Dir = s.project.root
 	output, err := command.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("rsync err:%s %s", err, string(output))
 	}
-	re := regexp.MustCompile("Number of files: (\\d+)\\s+Number of files transferred: (\\d+)\\s+Total file size: (\\d+) bytes\\s+Total transferred file size: (\\d+) bytes")
-	rsyncStat := re.FindStringSubmatch(string(output))
+	rsyncStat := rsyncStatRe.FindStringSubmatch(string(output))
 	if len(rsyncStat) == 5 {
-		log.Printf("rsync transferred %s(%s bytes) of %s(%s bytes)", rsyncStat[2], rsyncStat[4], rsyncStat[1], rsyncStat[3])
+		log.Printf("%s rsync %s transferred %s(%s bytes) of %s(%s bytes)", s.host, path, rsyncStat[2], rsyncStat[4], rsyncStat[1], rsyncStat[3])
 	} else {
 		log.Println("bad rsync stat", string(output))
 	}
+	return nil
+}
+
+// resyncSession runs rsync while the session is open, pinging lsa-space to keep it from timing out,
+// with must the changes are known only to rsync and its failure ends the session
+func (s *Space) resyncSession(ctx context.Context, ping func() error, path string, must bool) error {
+	if s.conf.Releases > 0 {
+		return errResync
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.rsync(ctx, path)
+	}()
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				log.Println(s.host, "resync", path, "failed:", err)
+				s.setError(err)
+				if path == "." || must {
+					// nothing is known about the space anymore
+					return err
+				}
+			}
+			return nil
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
 
-	args = sshOptions()
-	args = append(args, hostUser, "lsa-space", s.dir)
-	command = execCommand("ssh", args...)
+func (s *Space) senderOne(ctx context.Context) error {
+	eventLog := &s.project.eventLog
+	sentSeq := eventLog.AddClient(s.String())
+	defer eventLog.RemoveClient(s.String())
+	defer s.project.stage.forget(s.String())
+	s.mu.Lock()
+	s.pings = nil
+	s.unacked = nil
+	s.st.Chunk = 0
+	s.mu.Unlock()
+
+	s.setState("rsync")
+	// whole project is synced anyway
+	for len(s.resyncCh) > 0 {
+		<-s.resyncCh
+	}
+	if err := s.rsync(ctx, "."); err != nil {
+		return err
+	}
+	// in release mode the rsync goes live with the first release
+	if s.conf.Releases == 0 {
+		s.setAcked(sentSeq)
+	}
+	// in barrier mode the rounds after the initial rsync commit together with the
+	// other spaces, the ones before it were synced by it
+	barrierMode := s.project.config().Barrier
+	var barrierFrom uint64
+	if barrierMode {
+		eventLog.HoldRounds(s.String(), sentSeq)
+		barrierFrom = eventLog.Head()
+		s.project.barrier.join(s.String(), barrierFrom)
+		defer s.project.barrier.leave(s.String())
+	}
+
+	args := lsa.SSHOptions()
+	args = append(args, s.hostUser(), "lsa-space")
+	if s.conf.Releases > 0 {
+		args = append(args, fmt.Sprint("-releases=", s.conf.Releases))
+	}
+	if len(s.conf.Relay) > 0 {
+		arg, err := lsa.RelayArg(s.conf.Relay)
+		if err != nil {
+			return err
+		}
+		args = append(args, arg)
+	}
+	args = append(args, s.dir)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	command := execCommand(ctx, "ssh", args...)
 	stdout, err := command.StdoutPipe()
 	if err != nil {
 		return err
 	}
 
-	readOk := true
-	ctx, cancel := context.WithCancel(context.Background())
+	readyCh := make(chan struct{}, 1)
 	go func() {
-		b := make([]byte, 512)
+		b := bufio.NewReader(stdout)
 		for {
-			_, err := stdout.Read(b)
+			rEv, err := lsa.UnmarshalRevent(b)
 			if err != nil {
-				readOk = false
 				cancel()
 				break
 			}
+			if rEv.Typ == lsa.TPing {
+				s.pong()
+			} else if rEv.Typ == lsa.TReady {
+				select {
+				case readyCh <- struct{}{}:
+				default:
+				}
+			} else if rEv.Typ == lsa.TError {
+				log.Println(s.host, rEv)
+				s.setError(fmt.Errorf("%s: %s", rEv.Dir, rEv.Name))
+			}
 		}
 	}()
 
@@ -115,154 +503,657 @@ func (s Space) senderOne() error {
 	if err = command.Start(); err != nil {
 		return err
 	}
-
-	bigFiles := make(map[string]bigFile)
 	defer func() {
-		for _, bf := range bigFiles {
-			bf.File.Close()
-		}
+		cancel()
+		command.Wait()
+		s.mu.Lock()
+		s.st.Since = time.Time{}
+		s.st.BigFiles = 0
+		s.mu.Unlock()
 	}()
+	s.mu.Lock()
+	s.st.Since = time.Now()
+	s.mu.Unlock()
+
+	bigFiles := make(map[string]*bigFile)
+	// big files in the order they came, streamed round-robin
+	var bigOrder []string
+	bigNext := 0
+	// streaming waits until then when the bandwidth limit is used up
+	var bigAt time.Time
+	// how fast the last chunk went into the pipe, 0 before the first one
+	var chunkSpeed float64
+	// events of files being changed, they are read again at retryAt
+	deferred := make(map[string]Event)
+	var retryAt time.Time
+	deferEvent := func(path string, ev Event) {
+		if old, ok := deferred[path]; ok && old.Since() < ev.Since() {
+			ev.since = old.Since()
+		}
+		log.Println(s.host, path, "is being changed, deferred")
+		deferred[path] = ev
+		retryAt = time.Now().Add(changingRetry)
+	}
 	buf := make([]byte, 0, 8192)
-	bigBuf := make([]byte, bigSize)
-	state := ""
-	prevState := state
+	state := "connected"
+	prevState := ""
 	var timeout time.Duration
-	for readOk {
-		timeout = 15 * time.Second
-		if len(bigFiles) != 0 || prevState != "all synced" {
-			// do a empty cycle faster for printing "all synced" earlier
-			timeout = 0
+	pingedSeq := sentSeq
+	releasedSeq := sentSeq
+	if s.conf.Releases > 0 {
+		s.mu.Lock()
+		releasedSeq = s.st.Acked
+		s.mu.Unlock()
+	}
+	// seq of the storm rsync is syncing, 0 if none
+	var syncing uint64
+	// end of the last round committed, in barrier mode later ones may be aborted
+	settledSeq := sentSeq
+	// big files in flight and deferred files hold back the ack of their event
+	ackable := func() uint64 {
+		seq := sentSeq
+		for _, bf := range bigFiles {
+			if bf.seq <= seq {
+				seq = bf.seq - 1
+			}
 		}
-		ctx, _ := context.WithTimeout(ctx, timeout)
-		evs := eventLog.Get(s.host, ctx)
-		if !readOk {
-			break
+		for _, ev := range deferred {
+			if ev.Since() <= seq {
+				seq = ev.Since() - 1
+			}
 		}
-		if prevState != state {
-			var m runtime.MemStats
-			runtime.ReadMemStats(&m)
-			log.Println(s.host, state, "mem sys", fmtSize(int(m.Sys)), "alloc", fmtSize(int(m.Alloc)), fmtSize(int(s.speedBytes)) + "ps")
-			prevState = state
+		// in release mode changes are acked once they are live
+		if s.conf.Releases > 0 && seq > releasedSeq {
+			seq = releasedSeq
+		}
+		if barrierMode && seq > settledSeq {
+			seq = settledSeq
+		}
+		if syncing != 0 && seq >= syncing {
+			seq = syncing - 1
+		}
+		return seq
+	}
+	// small writes and deletes go out together, any other frame sends them first
+	var batch []*lsa.Revent
+	batchSize := 0
+	flushBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		rEv := batch[0]
+		if len(batch) > 1 {
+			rEv = &lsa.Revent{Typ: lsa.TBatch, Batch: batch}
+		}
+		batch, batchSize = nil, 0
+		return s.write(stdin, buf, rEv)
+	}
+	queue := func(rEv *lsa.Revent) error {
+		batch = append(batch, rEv)
+		batchSize += len(rEv.Dir) + len(rEv.Name) + len(rEv.Content)
+		if len(batch) >= batchFiles || batchSize >= batchBytes {
+			return flushBatch()
+		}
+		return nil
+	}
+	writeFrame := func(rEv *lsa.Revent) error {
+		if err := flushBatch(); err != nil {
+			return err
 		}
+		return s.write(stdin, buf, rEv)
+	}
+	// with transactions small writes and deletes of a diff round are staged by
+	// lsa-space until the commit, the round is in the log as a whole
+	txOpen := false
+	begin := func() error {
+		if txOpen || !s.conf.Transactions && !barrierMode {
+			return nil
+		}
+		txOpen = true
+		return writeFrame(&lsa.Revent{Typ: lsa.TBegin})
+	}
+	commit := func() error {
+		if !txOpen {
+			return nil
+		}
+		txOpen = false
+		return writeFrame(&lsa.Revent{Typ: lsa.TCommit})
+	}
+	abort := func() error {
+		if !txOpen {
+			return nil
+		}
+		txOpen = false
+		return writeFrame(&lsa.Revent{Typ: lsa.TAbort})
+	}
+	// in release mode something was synced since the last release, the initial rsync at first
+	unreleased := s.conf.Releases > 0
+	// left the barrier when paused, the others do not wait for it
+	left := false
+	// acks nothing staged, so it commits first, in barrier mode only the barrier commits
+	ping := func() error {
+		if !barrierMode {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+		if err := flushBatch(); err != nil {
+			return err
+		}
+		pingedSeq = ackable()
+		return s.ping(stdin, buf, pingedSeq)
+	}
+	// removeBig drops the big file, lsa-space is told when the stream has begun
+	removeBig := func(path string) error {
+		bf, ok := bigFiles[path]
+		if !ok {
+			return nil
+		}
+		delete(bigFiles, path)
+		for i := range bigOrder {
+			if bigOrder[i] == path {
+				bigOrder = append(bigOrder[:i], bigOrder[i+1:]...)
+				if i < bigNext {
+					bigNext--
+				}
+				break
+			}
+		}
+		if !bf.started {
+			return nil
+		}
+		dir, name := filepath.Split(path)
+		rEv := lsa.Revent{Typ: lsa.TBigCancel, Dir: strings.TrimRight(dir, "/"), Name: name}
+		return writeFrame(&rEv)
+	}
+	// sendBig sends a chunk of the next stream, at most maxStreams are open at once
+	sendBig := func() error {
+		now := time.Now()
+		if d := s.throttle(now); d > 0 {
+			bigAt = now.Add(d)
+			return nil
+		}
+		maxStreams := s.project.config().bigStreams()
+		streams := 0
+		for _, bf := range bigFiles {
+			if bf.started {
+				streams++
+			}
+		}
+		for i := 0; i < len(bigOrder); i++ {
+			idx := (bigNext + i) % len(bigOrder)
+			path := bigOrder[idx]
+			bf := bigFiles[path]
+			if !bf.started && streams >= maxStreams {
+				continue
+			}
+			bigNext = idx + 1
 
-		if len(bigFiles) != 0 {
-			state = "sending big"
-			for path, bf := range bigFiles {
-				dir, name := filepath.Split(path)
-				rEv := lsa.Revent{Typ: lsa.TBig, Dir: strings.TrimRight(dir, "/"), Name: name, Stat: bf.Stat}
-				curOff, err := bf.File.Seek(0, io.SeekCurrent)
-				if err != nil {
+			dir, name := filepath.Split(path)
+			rEv := lsa.Revent{Typ: lsa.TBig, Dir: strings.TrimRight(dir, "/"), Name: name, Stat: bf.Stat}
+			conf := s.project.config()
+			size := int(bf.Stat.Size() - bf.off)
+			if chunk := s.nextChunk(conf, chunkSpeed); size > chunk {
+				size = chunk
+			}
+			c, err := s.project.stage.chunk(s.String(), s.project.root, path, bf.fi, bf.off, size)
+			if err == errFileChanging {
+				// start over once the file settles
+				if err = removeBig(path); err != nil {
 					return err
 				}
-				size := int(bf.Stat.Size() - curOff)
-				if size > bigSize {
-					size = bigSize
+				deferEvent(path, bf.ev)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rEv.Content = c.content
+			size = len(c.content)
+			bf.off += int64(size)
+			bf.started = true
+
+			// with transactions a big file outlives its round, it commits on its own
+			ownTx := false
+			if bf.off == bf.Stat.Size() {
+				rEv.Typ = lsa.TBigFinish
+				// staged only when a barrier round is open
+				if barrierMode && !txOpen {
+					s.unbarriered()
 				}
-				n, err := io.ReadAtLeast(bf.File, bigBuf, size)
-				if err != nil {
+				ownTx = !barrierMode && !txOpen && s.conf.Transactions
+				// finished, there is nothing to cancel
+				bf.started = false
+				removeBig(path)
+			}
+			s.limit.spend(now, size)
+			globalLimit.spend(now, size)
+			if ownTx {
+				if err = begin(); err != nil {
 					return err
 				}
-				if n != size {
-					return fmt.Errorf("big.ReadAtLeast %d %d", n, size)
+			}
+			if err = flushBatch(); err != nil {
+				return err
+			}
+			t := time.Now()
+			if err = s.write(stdin, buf, &rEv); err != nil {
+				return err
+			}
+			if elapsed := time.Since(t); elapsed > 0 {
+				chunkSpeed = float64(size) / elapsed.Seconds()
+			}
+			if ownTx {
+				if err = commit(); err != nil {
+					return err
 				}
-				rEv.Content = bigBuf[:n]
+			}
+			if conf.AdaptiveChunks && s.pingsInFlight() == 0 {
+				// keeps the RTT measured while nothing else is pinged
+				return ping()
+			}
+			return nil
+		}
+		return nil
+	}
+	// vote ends a round in barrier mode: once lsa-space has staged it the barrier
+	// tells to commit it or to drop it and take it again
+	vote := func(top uint64) error {
+		if err := writeFrame(&lsa.Revent{Typ: lsa.TPrepare}); err != nil {
+			return err
+		}
+		s.setState("barrier")
+		wait := s.project.config().BarrierTimeout.Or(defaultBarrierTimeout)
+		// lsa-space gives up on a quiet session, it is pinged while the round waits
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		// a relay is ready once its downstreams are
+		t := time.NewTimer(wait)
+		defer t.Stop()
+	staged:
+		for {
+			select {
+			case <-readyCh:
+				break staged
+			case <-t.C:
+				return fmt.Errorf("round %d not staged in %s", top, wait)
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+				if err := ping(); err != nil {
+					return err
+				}
+			}
+		}
+		var ok bool
+		voted := make(chan error, 1)
+		go func() {
+			var err error
+			ok, err = s.project.barrier.vote(ctx, s.String(), top, wait)
+			voted <- err
+		}()
+		var err error
+	decided:
+		for {
+			select {
+			case err = <-voted:
+				break decided
+			case <-ticker.C:
+				if err = ping(); err != nil {
+					// the vote goroutine ends with ctx
+					return err
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Println(s.host, "round", top, "aborted")
+			if err = abort(); err != nil {
+				return err
+			}
+			eventLog.Rewind(s.String())
+			sentSeq = settledSeq
+			return nil
+		}
+		if err = commit(); err != nil {
+			return err
+		}
+		settledSeq = top
+		eventLog.Settle(s.String(), top)
+		return nil
+	}
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		s.st.State = state
+		s.st.BigFiles = len(bigFiles)
+		s.mu.Unlock()
 
-				if curOff+int64(n) == bf.Stat.Size() {
-					bf.File.Close()
-					delete(bigFiles, path)
-					rEv.Typ = lsa.TBigFinish
+		// resyncs and pauses wait for the open transaction to be committed
+		if !txOpen {
+			select {
+			case path := <-s.resyncCh:
+				state = "resync"
+				s.setState(state)
+				log.Println(s.host, state, path)
+				prevState = state
+				unreleased = true
+				if err = s.resyncSession(ctx, ping, path, false); err != nil {
+					return err
 				}
-				if err = s.write(stdin, buf, &rEv); err != nil {
+				continue
+			default:
+			}
+		}
+
+		if !txOpen && s.paused() {
+			state = "paused"
+			if prevState != state {
+				log.Println(s.host, state)
+				prevState = state
+			}
+			if barrierMode && !left {
+				s.project.barrier.leave(s.String())
+				left = true
+			}
+			s.setState(state)
+			select {
+			case <-ctx.Done():
+			case <-s.wake:
+			case <-time.After(15 * time.Second):
+			}
+			if err = ping(); err != nil {
+				return err
+			}
+			continue
+		}
+		if left {
+			// the changes made while paused are synced by rsync, the rounds after
+			// it are voted for again as after the initial one
+			left = false
+			state = "resync"
+			log.Println(s.host, state, "after pause")
+			prevState = state
+			s.setState(state)
+			seq := eventLog.Skip(s.String())
+			s.project.stage.forget(s.String())
+			for path := range bigFiles {
+				if err = removeBig(path); err != nil {
 					return err
 				}
+			}
+			deferred = make(map[string]Event)
+			unreleased = true
+			if err = s.resyncSession(ctx, ping, ".", true); err != nil {
+				return err
+			}
+			sentSeq, settledSeq = seq, seq
+			barrierFrom = eventLog.Head()
+			s.project.barrier.join(s.String(), barrierFrom)
+			continue
+		}
 
-				break
+		timeout = 15 * time.Second
+		if prevState != "all synced" && prevState != "storm" {
+			// do a empty cycle faster for printing "all synced" earlier
+			timeout = 0
+		}
+		if unreleased && !s.project.inStorm() {
+			// the release goes at the sync point right away
+			timeout = 0
+		}
+		if len(bigFiles) != 0 {
+			// zero unless the bandwidth limit holds big files back
+			timeout = time.Until(bigAt)
+		} else if len(deferred) != 0 {
+			timeout = time.Until(retryAt)
+		}
+		if timeout < 0 || txOpen {
+			timeout = 0
+		}
+		getCtx, getCancel := context.WithTimeout(ctx, timeout)
+		go func() {
+			// pause and resync requests should not wait for the next event
+			select {
+			case <-s.wake:
+				getCancel()
+			case <-getCtx.Done():
 			}
+		}()
+		evs, err := eventLog.Get(s.String(), getCtx)
+		getCancel()
+		if ctx.Err() != nil {
+			break
+		}
+		if gap, ok := err.(*GapError); ok {
+			state = "resync"
+			log.Println(s.host, gap)
+			s.setError(gap)
+			// skipped events will not be asked for
+			s.project.stage.forget(s.String())
+			prevState = state
+			s.setState(state)
+			// the resync covers the skipped streams and deferred files as well
+			for path := range bigFiles {
+				if err = removeBig(path); err != nil {
+					return err
+				}
+			}
+			deferred = make(map[string]Event)
+			if barrierMode {
+				// the resync covers the rounds up to the gap, the others do not wait for them
+				if err = abort(); err != nil {
+					return err
+				}
+				barrierFrom, settledSeq = gap.Seq, gap.Seq
+				s.project.barrier.join(s.String(), gap.Seq)
+			} else if err = commit(); err != nil {
+				return err
+			}
+			unreleased = true
+			if err = s.resyncSession(ctx, ping, ".", true); err != nil {
+				return err
+			}
+			sentSeq = gap.Seq
+			continue
+		}
+		s.taken(evs)
+		if len(evs) > 0 {
+			unreleased = true
+		}
+		// the latest event taken tells if the round is over
+		roundDone := true
+		var top uint64
+		for _, ev := range evs {
+			if ev.seq > top {
+				top, roundDone = ev.seq, ev.roundEnd
+			}
+		}
+		// every space votes for a round even with nothing to stage
+		barrierRound := barrierMode && top > barrierFrom
+		if barrierRound {
+			if err = begin(); err != nil {
+				return err
+			}
+		}
+		if prevState != state {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			log.Println(s.host, state, "mem sys", fmtSize(int(m.Sys)), "alloc", fmtSize(int(m.Alloc)), s.rates())
+			prevState = state
+		}
+
+		retried := false
+		if len(deferred) != 0 && !time.Now().Before(retryAt) {
+			for _, ev := range deferred {
+				evs = append(evs, ev)
+			}
+			deferred = make(map[string]Event)
+			retried = true
+		}
+		prioritize(s.project.config().Priorities, evs)
+		if len(evs) == 0 && len(bigFiles) == 0 && len(deferred) != 0 {
+			state = "files being changed"
+			if err = commit(); err != nil {
+				return err
+			}
+			continue
 		}
 		if len(evs) == 0 && len(bigFiles) == 0 {
 			state = "all synced"
-			rEv := lsa.Revent{Typ: lsa.TPing}
-			if err = s.write(stdin, buf, &rEv); err != nil {
+			if s.project.inStorm() {
+				state = "storm"
+			} else if unreleased && s.conf.Releases > 0 {
+				// a sync point, the tree lsa-space has got goes live
+				if err = commit(); err != nil {
+					return err
+				}
+				if err = writeFrame(&lsa.Revent{Typ: lsa.TRelease}); err != nil {
+					return err
+				}
+				unreleased = false
+				releasedSeq = sentSeq
+			}
+			if err = ping(); err != nil {
 				return err
 			}
 			continue
 		}
 		for _, ev := range evs {
 			state = "syncing"
+			// collapsed events keep the seq of the latest change
+			if ev.seq > sentSeq {
+				sentSeq = ev.seq
+			}
+			if ev.bulk {
+				// rsync takes the whole subtree, streams under it would be stale
+				for path := range bigFiles {
+					if ev.dir != "." && !strings.HasPrefix(path, ev.dir+"/") {
+						continue
+					}
+					if err = removeBig(path); err != nil {
+						return err
+					}
+				}
+				for path := range deferred {
+					if ev.dir == "." || strings.HasPrefix(path, ev.dir+"/") {
+						delete(deferred, path)
+					}
+				}
+				state = "bulk sync"
+				s.setState(state)
+				log.Println(s.host, state, ev.dir)
+				prevState = state
+				// writes read before the bulk event must not land after rsync,
+				// storms are synced outside of the barrier
+				if err = commit(); err != nil {
+					return err
+				}
+				if barrierMode {
+					s.unbarriered()
+				}
+				if err = flushBatch(); err != nil {
+					return err
+				}
+				// pings during rsync must not ack the storm
+				syncing = ev.Since()
+				if err = s.resyncSession(ctx, ping, ev.dir, true); err != nil {
+					return err
+				}
+				syncing = 0
+				continue
+			}
 			path := filepath.Join(ev.dir, ev.name)
 
-			if bf, ok := bigFiles[path]; ok {
-				rEv := lsa.Revent{Typ: lsa.TBigCancel, Dir: ev.dir, Name: ev.name}
-				if err = s.write(stdin, buf, &rEv); err != nil {
-					return err
+			if old, ok := deferred[path]; ok {
+				// the newer event reads the file anyway
+				if old.Since() < ev.Since() {
+					ev.since = old.Since()
 				}
-				bf.File.Close()
-				delete(bigFiles, path)
+				delete(deferred, path)
+			}
+			if err = removeBig(path); err != nil {
+				return err
 			}
 
 			rEv := lsa.Revent{Dir: ev.dir, Name: ev.name}
 
-			fi, err := os.Lstat(path)
-			var fp *os.File
-			if err == nil && fi.Mode() & os.ModeSymlink == 0 {
-				fp, err = os.Open(path)
-				if err == nil {
-					fi, err = fp.Stat()
-					if err != nil {
-						fp.Close()
-						return err
-					}
+			if ev.isDelete {
+				// a path created again after its delete has a write event of its own
+				rEv.Typ = lsa.TDelete
+			} else {
+				// read once for all the spaces
+				threshold := s.project.config().bigThreshold()
+				c, err := s.project.stage.file(s.String(), s.project.root, path, ev.seq, threshold)
+				if err == errFileChanging {
+					deferEvent(path, ev)
+					continue
 				}
-			}
-
-			if err != nil {
-				if !os.IsNotExist(err) {
+				if os.IsNotExist(err) {
+					// deleted since, its delete event comes later
+					continue
+				}
+				if err != nil {
 					return err
 				}
-				if !ev.isDelete {
+				rEv.Stat = c.stat
+				rEv.Typ = lsa.TWrite
+				if c.stat.IsLink() || !c.stat.IsDir() && c.stat.Size() <= int64(threshold) {
+					rEv.Content = c.content
+				} else if !c.stat.IsDir() {
+					// streamed after the small files
+					bigFiles[path] = &bigFile{Stat: c.stat, fi: c.fi, ev: ev, seq: ev.Since()}
+					bigOrder = append(bigOrder, path)
 					continue
 				}
-				rEv.Typ = lsa.TDelete
-			} else {
-				rEv.Stat = lsa.NewStat(fi)
-				if fi.Mode() & os.ModeSymlink != 0 {
-					rEv.Typ = lsa.TWrite
-					symlink, err := os.Readlink(path)
-					if err != nil {
-						return err
-					}
-					rEv.Content = []byte(symlink)
-				} else if fi.IsDir() {
-					rEv.Typ = lsa.TWrite
-					fp.Close()
-				} else if fi.Size() > bigSize {
-					rEv.Typ = lsa.TBig
-					bigFiles[path] = bigFile{
-						File: fp,
-						Stat: lsa.NewStat(fi),
-					}
-					_, err = io.ReadAtLeast(fp, bigBuf, bigSize)
-					if err != nil {
-						return err
-					}
-					rEv.Content = bigBuf
-				} else {
-					rEv.Typ = lsa.TWrite
-					rEv.Content, err = ioutil.ReadAll(fp)
-					fp.Close()
-					if err != nil {
-						return err
-					}
-				}
 			}
 
-			if err = s.write(stdin, buf, &rEv); err != nil {
+			if err = begin(); err != nil {
+				return err
+			}
+			if err = queue(&rEv); err != nil {
+				return err
+			}
+		}
+		if txOpen && !roundDone {
+			continue
+		}
+		if barrierRound && roundDone {
+			// a storm may have committed the round so far
+			if err = begin(); err != nil {
+				return err
+			}
+			if err = vote(top); err != nil {
+				return err
+			}
+		} else {
+			// files retried with no round to go with are not voted for
+			if barrierMode && retried && txOpen {
+				s.unbarriered()
+			}
+			if err = commit(); err != nil {
+				return err
+			}
+			if barrierMode && !barrierRound && top > settledSeq {
+				settledSeq = top
+				eventLog.Settle(s.String(), top)
+			}
+		}
+		if err = flushBatch(); err != nil {
+			return err
+		}
+		if len(bigFiles) != 0 {
+			state = "sending big"
+			if err = sendBig(); err != nil {
+				return err
+			}
+		}
+		if ackable() > pingedSeq {
+			if err = ping(); err != nil {
 				return err
 			}
 		}
-	}
-	if err = command.Process.Kill(); err != nil {
-		return err
 	}
 	return fmt.Errorf("read is not ok")
 }
@@ -275,22 +1166,119 @@ func (s *Space) write(stdin io.WriteCloser, buf []byte, rEv *lsa.Revent) (err er
 		return
 	}
 	w := stdin
-	t := time.Now()
 	if wrote, err = w.Write(buf); err != nil || wrote != len(buf) {
 		return
 	}
-	s.speedBytes += uint(wrote)
-	s.speedTime += time.Now().Sub(t)
-	s.speedBytes = uint(float64(s.speedBytes) / s.speedTime.Seconds())
-	s.speedTime = time.Second
+
+	now := time.Now()
+	s.mu.Lock()
+	s.bytesWin.add(now, float64(wrote))
+	s.framesWin.add(now, 1)
+	s.st.BytesSent += uint64(wrote)
+	if rEv.Typ == lsa.TWrite || rEv.Typ == lsa.TDelete || rEv.Typ == lsa.TBigFinish {
+		s.st.FilesSent++
+		s.filesWin.add(now, 1)
+	} else if rEv.Typ == lsa.TBatch {
+		s.st.FilesSent += uint64(len(rEv.Batch))
+		s.filesWin.add(now, float64(len(rEv.Batch)))
+	}
+	s.mu.Unlock()
 
 	return
 }
 
-func (s Space) sender() {
+// errResync ends a session in release mode, the files of releases/next are
+// shared with the live release so rsync goes only before lsa-space starts
+var errResync = errors.New("resync needs a new session")
+
+func (s *Space) sender(ctx context.Context) {
+	defer close(s.done)
 	for {
-		err := s.senderOne()
+		err := s.senderOne(ctx)
+		if ctx.Err() != nil {
+			log.Println(s.host, "sender stopped")
+			return
+		}
+		if err == errResync {
+			log.Println(s.host, err)
+			continue
+		}
 		log.Println(s.host, "sender error:", err)
-		time.Sleep(5 * time.Second)
+		s.setError(err)
+		s.setState("disconnected")
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (s *Space) start() {
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	s.done = make(chan struct{})
+	go s.sender(ctx)
+}
+
+func (s *Space) stop() {
+	s.cancel()
+	<-s.done
+}
+
+type spaceSet map[string]*Space
+
+// sameSession tells if the space can keep running with the new config, the limit is changed in place
+func sameSession(old, conf SpaceConfig) bool {
+	old.Bwlimit, conf.Bwlimit = 0, 0
+	return reflect.DeepEqual(old, conf)
+}
+
+// update starts spaces that appeared in confs and stops the ones that are gone,
+// spaces with unchanged config keep running
+func (ss spaceSet) update(p *Project, confs []SpaceConfig) error {
+	want := make(map[string]*Space)
+	for _, conf := range confs {
+		if old, ok := ss[conf.Spec]; ok && sameSession(old.conf, conf) {
+			if old.conf.Bwlimit != conf.Bwlimit {
+				log.Println(old.host, "bandwidth limit", conf.Bwlimit, "KiB/s")
+				old.conf.Bwlimit = conf.Bwlimit
+				old.setLimit(conf.Bwlimit)
+			}
+			want[conf.Spec] = old
+			continue
+		}
+		sp, err := NewSpace(p, conf)
+		if err != nil {
+			return err
+		}
+		want[sp.String()] = sp
+	}
+
+	var stopping []*Space
+	for name, sp := range ss {
+		if want[name] != sp {
+			log.Println(sp.host, "removing space", name)
+			sp.cancel()
+			stopping = append(stopping, sp)
+			delete(ss, name)
+		}
+	}
+	for _, sp := range stopping {
+		<-sp.done
+	}
+	for name, sp := range want {
+		if _, ok := ss[name]; !ok {
+			log.Println(sp.host, "adding space", name)
+			ss[name] = sp
+			sp.start()
+		}
+	}
+	return nil
+}
+
+func (ss spaceSet) stopAll() {
+	for name, sp := range ss {
+		sp.stop()
+		delete(ss, name)
 	}
 }
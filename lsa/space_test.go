@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"eelf.ru/lsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperSpace stands for lsa-space when run by the fake ssh, it writes the
+// frames it gets to a file named after the dir in LSA_TEST_FRAMES and answers
+// pings and prepares
+func TestHelperSpace(t *testing.T) {
+	frames := os.Getenv("LSA_TEST_FRAMES")
+	if frames == "" {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(frames, filepath.Base(os.Args[len(os.Args)-1])), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		os.Exit(1)
+	}
+	pingReply := make([]byte, 0, 1)
+	pong := lsa.Revent{Typ: lsa.TPing}
+	if err = pong.Marshal(&pingReply); err != nil {
+		os.Exit(1)
+	}
+	readyReply := make([]byte, 0, 1)
+	ready := lsa.Revent{Typ: lsa.TReady}
+	if err = ready.Marshal(&readyReply); err != nil {
+		os.Exit(1)
+	}
+	b := bufio.NewReader(os.Stdin)
+	for {
+		rEv, err := lsa.UnmarshalRevent(b)
+		if err != nil {
+			os.Exit(0)
+		}
+		evs := []*lsa.Revent{rEv}
+		if rEv.Typ == lsa.TBatch {
+			evs = rEv.Batch
+		}
+		for _, ev := range evs {
+			fmt.Fprintln(f, strings.Fields(ev.String())[0], ev.Name)
+		}
+		if rEv.Typ == lsa.TPing {
+			os.Stdout.Write(pingReply)
+		} else if rEv.Typ == lsa.TPrepare {
+			os.Stdout.Write(readyReply)
+		}
+	}
+}
+
+// fakeRemote puts ssh running TestHelperSpace and a no-op rsync first in PATH,
+// the frames of the spaces go to dir
+func fakeRemote(t *testing.T, dir string) {
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts := map[string]string{
+		// the dir is the last arg
+		"ssh":   "#!/bin/sh\nfor dir; do :; done\nexec '" + bin + "' -test.run='^TestHelperSpace$' \"$dir\"\n",
+		"rsync": "#!/bin/sh\nexit 0\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv("LSA_TEST_FRAMES", dir)
+}
+
+// frameLog reads the frames a space got
+type frameLog struct {
+	t    *testing.T
+	path string
+	// lines looked at so far
+	seen int
+}
+
+// wait waits for want after the frames seen so far and fails on stop
+func (f *frameLog) wait(want, stop string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		content, _ := ioutil.ReadFile(f.path)
+		// the last one is not complete yet
+		lines := strings.Split(string(content), "\n")
+		lines = lines[:len(lines)-1]
+		for ; f.seen < len(lines); f.seen++ {
+			line := strings.TrimSpace(lines[f.seen])
+			if line == stop {
+				f.t.Fatalf("%s: got %q before %q", filepath.Base(f.path), stop, want)
+			}
+			if line == want {
+				f.seen++
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.t.Fatalf("%s: no %q in 10s", filepath.Base(f.path), want)
+}
+
+// startSender runs the sender of a space until the returned func is called
+func startSender(s *Space) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.senderOne(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// fakeProject makes the project root in a temp dir with the fake remote in PATH,
+// the returned func cleans up
+func fakeProject(t *testing.T, conf ProjectConfig) (*Project, string, func()) {
+	tmp, err := ioutil.TempDir("", "lsa-sender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	cleanup := func() {
+		os.Setenv("PATH", path)
+		os.Unsetenv("LSA_TEST_FRAMES")
+		os.RemoveAll(tmp)
+	}
+	fakeRemote(t, tmp)
+	conf.Root = filepath.Join(tmp, "root")
+	if err = os.Mkdir(conf.Root, 0755); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	p, err := NewProject(conf)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return p, tmp, cleanup
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("not %s in 10s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connected waits for the session of the space to start
+func connected(t *testing.T, s *Space) {
+	waitFor(t, s.String()+" connected", func() bool {
+		return !s.status().Since.IsZero()
+	})
+}
+
+func TestSenderCommitsWhileBigStreams(t *testing.T) {
+	p, tmp, cleanup := fakeProject(t, ProjectConfig{BigThreshold: 1 << 10, ChunkSize: minChunk})
+	defer cleanup()
+	// at 64 KiB/s the big file takes a minute to stream
+	if err := ioutil.WriteFile(filepath.Join(p.root, "big"), make([]byte, 4<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSpace(p, SpaceConfig{Spec: "host:/dir", Transactions: true, Bwlimit: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer startSender(s)()
+	connected(t, s)
+	frames := &frameLog{t: t, path: filepath.Join(tmp, "dir")}
+
+	p.eventLog.Add([]Event{{dir: ".", name: "big"}})
+	frames.wait("big big", "bigfin big")
+	if err = ioutil.WriteFile(filepath.Join(p.root, "small"), []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.eventLog.Add([]Event{{dir: ".", name: "small"}})
+	// the round of the small write lands while the big file is still streaming
+	frames.wait("begin", "bigfin big")
+	frames.wait("write small", "bigfin big")
+	frames.wait("commit", "bigfin big")
+}
+
+func TestSenderPauseLeavesBarrier(t *testing.T) {
+	p, tmp, cleanup := fakeProject(t, ProjectConfig{Barrier: true, BarrierTimeout: Duration(time.Minute)})
+	defer cleanup()
+	var spaces []*Space
+	for _, spec := range []string{"host:/a", "host:/b"} {
+		s, err := NewSpace(p, SpaceConfig{Spec: spec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer startSender(s)()
+		connected(t, s)
+		spaces = append(spaces, s)
+	}
+	a, b := spaces[0], spaces[1]
+	framesA := &frameLog{t: t, path: filepath.Join(tmp, "a")}
+	framesB := &frameLog{t: t, path: filepath.Join(tmp, "b")}
+	members := func(n int) func() bool {
+		return func() bool {
+			p.barrier.mu.Lock()
+			defer p.barrier.mu.Unlock()
+			return len(p.barrier.members) == n
+		}
+	}
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(p.root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p.eventLog.Add([]Event{{dir: ".", name: name}})
+	}
+
+	b.setPaused(true)
+	waitFor(t, "b left", members(1))
+	// a commits without waiting for the paused b
+	write("one")
+	framesA.wait("write one", "")
+	framesA.wait("commit", "abort")
+
+	// b is synced by rsync and takes part in the rounds after it
+	b.setPaused(false)
+	waitFor(t, "b joined", members(2))
+	write("two")
+	framesA.wait("write two", "")
+	framesA.wait("commit", "abort")
+	framesB.wait("write two", "write one")
+	framesB.wait("commit", "abort")
+	if st := a.status(); st.Unbarriered != 0 {
+		t.Fatalf("a synced %d outside of the barrier", st.Unbarriered)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"container/list"
+	"eelf.ru/lsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultStageMemory = 128 << 20
+
+// stageKey names a whole file when off is -1 with size being the big file
+// threshold, otherwise a chunk of length bytes of the file version with the
+// given size and mtime in nanoseconds
+type stageKey struct {
+	path        string
+	off         int64
+	size, mtime int64
+	length      int
+}
+
+// staged is content read once for every space of the project
+type staged struct {
+	ready chan struct{}
+	// head of the event log before the read, the content is fresh for events up to it
+	seq  uint64
+	stat *lsa.Stat
+	// the version read, big file chunks have to come from the same one
+	fi      os.FileInfo
+	content []byte
+	err     error
+
+	// spaces which have not taken it yet
+	waiting map[string]bool
+	elem    *list.Element
+	counted int
+}
+
+// contentStage shares file reads between the spaces of a project, an entry is
+// dropped when every space took it, left or the memory limit is hit
+type contentStage struct {
+	eventLog *EventLog
+	mu       sync.Mutex
+	entries  map[stageKey]*staged
+	order    *list.List
+	bytes    int
+	limit    int
+}
+
+func newContentStage(eventLog *EventLog) *contentStage {
+	return &contentStage{
+		eventLog: eventLog,
+		entries:  make(map[stageKey]*staged),
+		order:    list.New(),
+		limit:    defaultStageMemory,
+	}
+}
+
+// file returns the stat and, for symlinks and files up to threshold, the content
+// of path read after the event with seq was added
+func (s *contentStage) file(client, root, path string, seq uint64, threshold int) (*staged, error) {
+	return s.get(client, stageKey{path: path, off: -1, size: int64(threshold)}, seq, func(e *staged) {
+		if e.fi, e.content, e.err = readFile(filepath.Join(root, path), int64(threshold)); e.err == nil {
+			e.stat = lsa.NewStat(e.fi)
+		}
+	})
+}
+
+// chunk returns size bytes at off of the file version fi
+func (s *contentStage) chunk(client, root, path string, fi os.FileInfo, off int64, size int) (*staged, error) {
+	key := stageKey{path: path, off: off, size: fi.Size(), mtime: fi.ModTime().UnixNano(), length: size}
+	return s.get(client, key, 0, func(e *staged) {
+		e.fi, e.stat = fi, lsa.NewStat(fi)
+		e.content, e.err = readChunk(filepath.Join(root, path), fi, off, size)
+	})
+}
+
+func (s *contentStage) get(client string, key stageKey, seq uint64, read func(*staged)) (*staged, error) {
+	s.mu.Lock()
+	if e, ok := s.entries[key]; ok && e.seq >= seq {
+		s.take(key, e, client)
+		s.mu.Unlock()
+		<-e.ready
+		return e, e.err
+	} else if ok {
+		s.drop(key, e)
+	}
+	e := &staged{
+		ready:   make(chan struct{}),
+		seq:     s.eventLog.Head(),
+		waiting: make(map[string]bool),
+	}
+	for _, name := range s.eventLog.Clients() {
+		if name != client {
+			e.waiting[name] = true
+		}
+	}
+	s.entries[key] = e
+	e.elem = s.order.PushBack(key)
+	s.mu.Unlock()
+
+	read(e)
+	close(e.ready)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[key] != e {
+		return e, e.err
+	}
+	if len(e.waiting) == 0 || e.err != nil {
+		s.drop(key, e)
+		return e, e.err
+	}
+	e.counted = len(e.content)
+	s.bytes += e.counted
+	for s.bytes > s.limit && s.order.Len() > 0 {
+		oldest := s.order.Front().Value.(stageKey)
+		s.drop(oldest, s.entries[oldest])
+	}
+	return e, e.err
+}
+
+func (s *contentStage) take(key stageKey, e *staged, client string) {
+	delete(e.waiting, client)
+	if len(e.waiting) == 0 {
+		s.drop(key, e)
+	}
+}
+
+func (s *contentStage) drop(key stageKey, e *staged) {
+	delete(s.entries, key)
+	s.order.Remove(e.elem)
+	s.bytes -= e.counted
+	e.counted = 0
+}
+
+// forget releases everything the client has not taken, it will not ask for it anymore
+func (s *contentStage) forget(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, e := range s.entries {
+		if e.waiting[client] {
+			s.take(key, e, client)
+		}
+	}
+}
+
+// errFileChanging means the file changed while it was read
+var errFileChanging = errors.New("file is being changed")
+
+func sameVersion(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime()) && a.Mode() == b.Mode()
+}
+
+// readFile reads a consistent snapshot of the file, a few times if it keeps changing
+func readFile(fullPath string, threshold int64) (fi os.FileInfo, content []byte, err error) {
+	for attempt := 1; ; attempt++ {
+		fi, content, err = readFileOnce(fullPath, threshold)
+		if err != errFileChanging || attempt == 3 {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+}
+
+func readFileOnce(fullPath string, threshold int64) (os.FileInfo, []byte, error) {
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		symlink, err := os.Readlink(fullPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err := os.Lstat(fullPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !sameVersion(fi, after) {
+			return nil, nil, errFileChanging
+		}
+		return fi, []byte(symlink), nil
+	}
+	if fi.IsDir() || fi.Size() > threshold {
+		return fi, nil, nil
+	}
+
+	fp, err := os.Open(fullPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fp.Close()
+	if fi, err = fp.Stat(); err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() > threshold {
+		return fi, nil, nil
+	}
+	content, err := ioutil.ReadAll(fp)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := fp.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sameVersion(fi, after) || int64(len(content)) != after.Size() {
+		return nil, nil, errFileChanging
+	}
+	return fi, content, nil
+}
+
+// readChunk reads size bytes at off, the file has to stay the version fi: the
+// same inode with the same size and mtime to the nanosecond
+func readChunk(fullPath string, fi os.FileInfo, off int64, size int) ([]byte, error) {
+	fp, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	before, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !os.SameFile(fi, before) || !sameVersion(fi, before) {
+		return nil, errFileChanging
+	}
+	content := make([]byte, size)
+	if _, err = fp.ReadAt(content, off); err != nil {
+		if err == io.EOF {
+			// truncated since the stream began
+			return nil, errFileChanging
+		}
+		return nil, err
+	}
+	after, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !sameVersion(before, after) {
+		return nil, errFileChanging
+	}
+	return content, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentStage(t *testing.T) {
+	root, err := ioutil.TempDir("", "lsa-stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(content string) {
+		if err := ioutil.WriteFile(filepath.Join(root, "f"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	el := NewEventLog()
+	for _, name := range []string{"a", "b", "c"} {
+		el.AddClient(name)
+	}
+	st := newContentStage(&el)
+
+	write("one")
+	el.Add([]Event{{dir: ".", name: "f"}})
+	c, err := st.file("a", root, "f", 1, defaultBigThreshold)
+	if err != nil || string(c.content) != "one" {
+		t.Fatalf("a read %q %v", c.content, err)
+	}
+	// b is given the same bytes even after the file changed
+	write("two")
+	if c, _ = st.file("b", root, "f", 1, defaultBigThreshold); string(c.content) != "one" {
+		t.Fatalf("b read %q", c.content)
+	}
+	if st.bytes != 3 {
+		t.Fatalf("%d bytes staged, c has not taken it", st.bytes)
+	}
+	st.forget("c")
+	if st.bytes != 0 || len(st.entries) != 0 {
+		t.Fatalf("%d bytes %d entries kept after everybody took it", st.bytes, len(st.entries))
+	}
+
+	// a newer event needs a newer read
+	el.Add([]Event{{dir: ".", name: "f"}})
+	if c, _ = st.file("a", root, "f", 1, defaultBigThreshold); string(c.content) != "two" {
+		t.Fatalf("a read %q", c.content)
+	}
+	write("three")
+	el.Add([]Event{{dir: ".", name: "f"}})
+	if c, _ = st.file("b", root, "f", 3, defaultBigThreshold); string(c.content) != "three" {
+		t.Fatalf("b read %q for a newer event", c.content)
+	}
+
+	if _, err = st.file("a", root, "missing", 3, defaultBigThreshold); !os.IsNotExist(err) {
+		t.Fatalf("missing file %v", err)
+	}
+
+	// spaces with different chunk sizes do not share chunks at the same offset
+	fi, err := os.Stat(filepath.Join(root, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err = st.chunk("a", root, "f", fi, 0, 2); err != nil || string(c.content) != "th" {
+		t.Fatalf("a chunk %q %v", c.content, err)
+	}
+	if c, err = st.chunk("b", root, "f", fi, 0, 4); err != nil || string(c.content) != "thre" {
+		t.Fatalf("b chunk %q %v", c.content, err)
+	}
+}
+
+func TestReadChunkChanged(t *testing.T) {
+	root, err := ioutil.TempDir("", "lsa-stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "big")
+	if err = ioutil.WriteFile(path, make([]byte, 3*defaultChunkSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readChunk(path, fi, defaultChunkSize, defaultChunkSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// replaced by a file of the same size and mtime
+	other := filepath.Join(root, "other")
+	if err = ioutil.WriteFile(other, make([]byte, 3*defaultChunkSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(other, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(other, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readChunk(path, fi, defaultChunkSize, defaultChunkSize); err != errFileChanging {
+		t.Fatalf("replaced file read with %v", err)
+	}
+	if fi, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// shrunk under the stream
+	if err = os.Truncate(path, defaultChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readChunk(path, fi, 2*defaultChunkSize, defaultChunkSize); err != errFileChanging {
+		t.Fatalf("truncated file read with %v", err)
+	}
+}
@@ -13,7 +13,7 @@ void watch(const char *path) {
         pathsToWatch,
         kFSEventStreamEventIdSinceNow,
         0.0,
-        kFSEventStreamCreateFlagNone|kFSEventStreamCreateFlagNoDefer
+        kFSEventStreamCreateFlagFileEvents|kFSEventStreamCreateFlagNoDefer
     );
 
     CFRelease(pathsToWatch);
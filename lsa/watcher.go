@@ -6,18 +6,34 @@ package main
 import "C"
 import "unsafe"
 
-var pathCh chan <- string
+// FSEventStreamEventFlags telling that events were coalesced or dropped
+const (
+	fsEventMustScanSubDirs = 0x00000001
+	fsEventUserDropped     = 0x00000002
+	fsEventKernelDropped   = 0x00000004
+)
+
+var pathCh chan <- WatchEvent
 
 //export watchCallback
 func watchCallback(s uintptr, info uintptr, n C.size_t, paths, flags, ids uintptr) {
 	const offsetChar = unsafe.Sizeof((*C.char)(nil))
+	const offsetFlags = unsafe.Sizeof(C.uint(0))
 
 	for i := uintptr(0); i < uintptr(n); i++ {
-		pathCh <- C.GoString(*(**C.char)(unsafe.Pointer(paths + i*offsetChar)))
+		ev := WatchEvent{Path: C.GoString(*(**C.char)(unsafe.Pointer(paths + i*offsetChar)))}
+		flag := *(*C.uint)(unsafe.Pointer(flags + i*offsetFlags))
+		if flag & (fsEventMustScanSubDirs|fsEventUserDropped|fsEventKernelDropped) != 0 {
+			ev.Overflow = true
+		} else {
+			// the stream is created with kFSEventStreamCreateFlagFileEvents
+			ev.Entry = true
+		}
+		pathCh <- ev
 	}
 }
 
-func Watch(path string, ch chan <- string) {
+func Watch(path string, ch chan <- WatchEvent) {
 	pathCh = ch
 	go C.watch(C.CString(path))
 }
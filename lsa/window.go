@@ -0,0 +1,76 @@
+package main
+
+import "time"
+
+const windowSecs = 10
+
+type windowBucket struct {
+	sum, max float64
+	count    int
+}
+
+// window keeps values added during the last windowSecs seconds in per-second buckets
+type window struct {
+	buckets [windowSecs]windowBucket
+	// second of the newest bucket
+	last  int64
+	start time.Time
+}
+
+func (w *window) advance(now time.Time) *windowBucket {
+	sec := now.Unix()
+	if w.start.IsZero() {
+		w.start = now
+		w.last = sec
+	}
+	if sec > w.last {
+		for s := w.last + 1; s <= sec && s <= w.last+windowSecs; s++ {
+			w.buckets[s%windowSecs] = windowBucket{}
+		}
+		w.last = sec
+	}
+	return &w.buckets[w.last%windowSecs]
+}
+
+func (w *window) add(now time.Time, v float64) {
+	b := w.advance(now)
+	b.sum += v
+	b.count++
+	if v > b.max {
+		b.max = v
+	}
+}
+
+func (w *window) total(now time.Time) (sum, max float64, count int) {
+	w.advance(now)
+	for _, b := range w.buckets {
+		sum += b.sum
+		count += b.count
+		if b.max > max {
+			max = b.max
+		}
+	}
+	return
+}
+
+// rate returns the sum per second, a young window is divided by its age
+func (w *window) rate(now time.Time) float64 {
+	sum, _, _ := w.total(now)
+	span := now.Sub(w.start).Seconds()
+	if span > windowSecs {
+		span = windowSecs
+	}
+	if span < 1 {
+		span = 1
+	}
+	return sum / span
+}
+
+// avg returns the average and the max of the added values
+func (w *window) avg(now time.Time) (avg, max float64) {
+	sum, max, count := w.total(now)
+	if count == 0 {
+		return 0, 0
+	}
+	return sum / float64(count), max
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	var w window
+	start := time.Unix(1000, 0)
+	if r := w.rate(start); r != 0 {
+		t.Fatalf("empty rate %v", r)
+	}
+	// a young window is divided by its age
+	w.add(start, 100)
+	w.add(start.Add(1500*time.Millisecond), 200)
+	if r := w.rate(start.Add(2 * time.Second)); r != 150 {
+		t.Fatalf("rate %v, want 150", r)
+	}
+	for i := 2; i < 20; i++ {
+		w.add(start.Add(time.Duration(i)*time.Second), 10)
+	}
+	// the last 10 seconds only
+	if r := w.rate(start.Add(19 * time.Second)); r != 10 {
+		t.Fatalf("rate %v, want 10", r)
+	}
+	if avg, max := w.avg(start.Add(19 * time.Second)); avg != 10 || max != 10 {
+		t.Fatalf("avg %v max %v, want 10 10", avg, max)
+	}
+	// idle for longer than the window
+	if r := w.rate(start.Add(time.Minute)); r != 0 {
+		t.Fatalf("idle rate %v", r)
+	}
+
+	var l window
+	l.add(start, 1)
+	l.add(start, 3)
+	if avg, max := l.avg(start); avg != 2 || max != 3 {
+		t.Fatalf("avg %v max %v, want 2 3", avg, max)
+	}
+}
@@ -0,0 +1,79 @@
+package lsa
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// TempPrefix starts the names of the temp files and dirs lsa-space keeps in the
+// target dir, rsync leaves them alone
+const TempPrefix = ".lsa"
+
+// RsyncRelease is where rsync syncs a space keeping releases to, lsa-space
+// makes releases/next of it when it starts
+const RsyncRelease = ".rsync"
+
+// RsyncArgs are the args every rsync to a space at dir starts with and the
+// dir to sync to. With releases it is a fresh dir which files are linked only
+// to identical ones of releases/next or current, so rsync never changes a file
+// of a live release in place
+func RsyncArgs(dir string, releases bool) (string, []string) {
+	args := []string{"-e", "ssh " + strings.Join(SSHOptions(), " ")}
+	if releases {
+		to := dir + "/releases/" + RsyncRelease
+		args = append(args, "--rsync-path=mkdir -p "+dir+"/releases && rm -rf "+to+" && rsync", "--link-dest=../next/", "--link-dest=../../current/")
+		dir = to
+	}
+	// big files being streamed and the open transaction are lsa-space's business
+	return dir, append(args, "--exclude=/"+TempPrefix+"*")
+}
+
+// Relay is a downstream of a relaying lsa-space, which may relay further
+type Relay struct {
+	Spec  string  `json:"spec"`
+	Relay []Relay `json:"relay,omitempty"`
+}
+
+// UnmarshalJSON takes a bare spec string for a downstream relaying no further
+func (r *Relay) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &r.Spec)
+	}
+	type plain Relay
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// RelayArg is the lsa-space flag handing the downstreams to a relay, quoted
+// for the remote shell ssh runs the command with
+func RelayArg(relays []Relay) (string, error) {
+	b, err := json.Marshal(relays)
+	if err != nil {
+		return "", err
+	}
+	return ShellQuote("-relay=" + string(b)), nil
+}
+
+// ShellQuote makes s a single word for sh
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// SSHOptions are the options of every ssh run by lsa and relays
+func SSHOptions() []string {
+	options := []string{
+		"-o", fmt.Sprint("ConnectTimeout=", 10),
+		"-o", "LogLevel=ERROR",
+		"-o", fmt.Sprint("ServerAliveInterval=", 3),
+		"-o", fmt.Sprint("ServerAliveCountMax=", 4),
+		//If set to yes, passphrase/password querying will be disabled. This option is useful in scripts and other batch jobs where no user is present to supply the password
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+	}
+	if false {
+		options = append(options, "-o", "Compression=yes")
+	}
+
+	return options
+}
@@ -0,0 +1,34 @@
+package lsa
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+)
+
+func TestRelayArg(t *testing.T) {
+	var relays []Relay
+	conf := `["h1:/www", {"spec": "h2:/it's", "relay": ["h3:/www"]}]`
+	if err := json.Unmarshal([]byte(conf), &relays); err != nil {
+		t.Fatal(err)
+	}
+	if len(relays) != 2 || relays[1].Spec != "h2:/it's" || len(relays[1].Relay) != 1 || relays[1].Relay[0].Spec != "h3:/www" {
+		t.Fatal("relays", relays)
+	}
+
+	arg, err := RelayArg(relays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sh", "-c", "printf %s "+arg).Output()
+	if err != nil {
+		t.Skip("no sh:", err)
+	}
+	var back []Relay
+	if err = json.Unmarshal(out[len("-relay="):], &back); err != nil {
+		t.Fatal(string(out), err)
+	}
+	if len(back) != 2 || back[1].Spec != "h2:/it's" || back[1].Relay[0].Spec != "h3:/www" {
+		t.Fatal("back", back)
+	}
+}
@@ -14,14 +14,36 @@ const (
 	TBig
 	TBigFinish
 	TBigCancel
+	// TBatch packs TWrite and TDelete events applied in order
+	TBatch
+	// writes and deletes between TBegin and TCommit become visible together
+	TBegin
+	TCommit
+	// TRelease marks a sync point, in release mode the tree synced so far goes live
+	TRelease
+	// TPrepare asks if the open transaction is staged, lsa-space answers TReady,
+	// TAbort drops it
+	TPrepare
+	TReady
+	TAbort
+	// TError tells what went wrong in Dir, a relay downstream or lsa-space's own
+	// dir when a commit fails
+	TError
 )
 
+// bare events are just the type
+func bare(typ uint8) bool {
+	return typ == TPing || typ == TBegin || typ == TCommit || typ == TRelease ||
+		typ == TPrepare || typ == TReady || typ == TAbort
+}
+
 type Revent struct {
 	Typ     uint8
 	Dir     string
 	Name    string
 	Stat    *Stat
 	Content []byte
+	Batch   []*Revent
 }
 
 func (s *Revent) marshalLengthy(b *bytes.Buffer, lengthy []byte) (err error) {
@@ -40,12 +62,34 @@ func (s *Revent) marshalLengthy(b *bytes.Buffer, lengthy []byte) (err error) {
 
 func (s *Revent) Marshal(buf *[]byte) (err error) {
 	b := bytes.NewBuffer(*buf)
+	if err = s.marshal(b); err != nil {
+		return
+	}
+	*buf = b.Bytes()
+	return
+}
+
+func (s *Revent) marshal(b *bytes.Buffer) (err error) {
 	if err = binary.Write(b, binary.LittleEndian, s.Typ); err != nil {
 		return
 	}
 
-	if s.Typ == TPing {
-		*buf = b.Bytes()
+	if bare(s.Typ) {
+		return
+	}
+
+	if s.Typ == TBatch {
+		if err = binary.Write(b, binary.LittleEndian, uint32(len(s.Batch))); err != nil {
+			return
+		}
+		for _, e := range s.Batch {
+			if e.Typ != TWrite && e.Typ != TDelete {
+				return fmt.Errorf("cannot batch %s", e)
+			}
+			if err = e.marshal(b); err != nil {
+				return
+			}
+		}
 		return
 	}
 
@@ -70,8 +114,6 @@ func (s *Revent) Marshal(buf *[]byte) (err error) {
 			return
 		}
 	}
-
-	*buf = b.Bytes()
 	return
 }
 
@@ -90,7 +132,26 @@ func UnmarshalRevent(b io.Reader) (s *Revent, err error) {
 	if err = binary.Read(b, binary.LittleEndian, &s.Typ); err != nil {
 		return nil, fmt.Errorf("UnmarshalRevent err:%v", err)
 	}
-	if s.Typ == TPing {
+	if bare(s.Typ) {
+		return
+	}
+
+	if s.Typ == TBatch {
+		var n uint32
+		if err = binary.Read(b, binary.LittleEndian, &n); err != nil {
+			return nil, fmt.Errorf("UnmarshalRevent batch size:%v", err)
+		}
+		// n comes from the wire, entries are appended as they are read
+		for i := uint32(0); i < n; i++ {
+			e, err := UnmarshalRevent(b)
+			if err != nil {
+				return nil, fmt.Errorf("UnmarshalRevent batch %d of %d: %v", i, n, err)
+			}
+			if e.Typ != TWrite && e.Typ != TDelete {
+				return nil, fmt.Errorf("UnmarshalRevent batch %d of %d: %s", i, n, e)
+			}
+			s.Batch = append(s.Batch, e)
+		}
 		return
 	}
 
@@ -135,6 +196,22 @@ func (s *Revent) String() string {
 		return fmt.Sprintf("delete %s/%s", s.Dir, s.Name)
 	} else if s.Typ == TBigCancel {
 		return fmt.Sprintf("cancel %s/%s", s.Dir, s.Name)
+	} else if s.Typ == TBatch {
+		return fmt.Sprintf("batch of %d", len(s.Batch))
+	} else if s.Typ == TBegin {
+		return "begin"
+	} else if s.Typ == TCommit {
+		return "commit"
+	} else if s.Typ == TRelease {
+		return "release"
+	} else if s.Typ == TPrepare {
+		return "prepare"
+	} else if s.Typ == TReady {
+		return "ready"
+	} else if s.Typ == TAbort {
+		return "abort"
+	} else if s.Typ == TError {
+		return fmt.Sprintf("error %s: %s", s.Dir, s.Name)
 	} else {
 		return "revent:unknown typ"
 	}
@@ -2,6 +2,7 @@ package lsa
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 )
 
@@ -34,3 +35,60 @@ func TestReventMarshalUnmarshal(t *testing.T) {
 		t.Fatal("stat")
 	}
 }
+
+func TestReventBatch(t *testing.T) {
+	us := &Stat{false, false, 0644, 0xdeadbeef0, 3}
+	rEv := Revent{Typ: TBatch, Batch: []*Revent{
+		{Typ: TWrite, Dir: "dira", Name: "a", Stat: us, Content: []byte("one")},
+		{Typ: TDelete, Dir: "dira", Name: "b"},
+	}}
+
+	buf := make([]byte, 0, 8192)
+	if err := rEv.Marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// bare events right after the batch are read on their own
+	for _, typ := range []uint8{TPing, TCommit} {
+		bare := Revent{Typ: typ}
+		if err := bare.Marshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bytes.NewReader(buf)
+	sEv, err := UnmarshalRevent(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sEv.Typ != TBatch || len(sEv.Batch) != 2 {
+		t.Fatal("batch", sEv)
+	}
+	if w := sEv.Batch[0]; w.Typ != TWrite || w.Dir != "dira" || w.Name != "a" || *w.Stat != *us || string(w.Content) != "one" {
+		t.Fatal("write", w)
+	}
+	if d := sEv.Batch[1]; d.Typ != TDelete || d.Dir != "dira" || d.Name != "b" {
+		t.Fatal("delete", d)
+	}
+	if sEv, err = UnmarshalRevent(r); err != nil || sEv.Typ != TPing {
+		t.Fatal("ping", sEv, err)
+	}
+	if sEv, err = UnmarshalRevent(r); err != nil || sEv.Typ != TCommit {
+		t.Fatal("commit", sEv, err)
+	}
+	if r.Len() != 0 {
+		t.Fatal("left", r.Len())
+	}
+
+	nested := Revent{Typ: TBatch, Batch: []*Revent{{Typ: TBatch}}}
+	if err = nested.Marshal(&buf); err == nil {
+		t.Fatal("nested batch marshaled")
+	}
+
+	// a huge count with nothing behind it is an error, not a huge allocation
+	var huge bytes.Buffer
+	binary.Write(&huge, binary.LittleEndian, TBatch)
+	binary.Write(&huge, binary.LittleEndian, uint32(1<<32-1))
+	if sEv, err = UnmarshalRevent(&huge); err == nil {
+		t.Fatal("truncated batch", sEv)
+	}
+}
@@ -26,6 +26,11 @@ func NewStat(fi os.FileInfo) *Stat {
 	}
 }
 
+// NewDirStat returns the stat of a dir which details are not known yet
+func NewDirStat() *Stat {
+	return &Stat{isDir: true}
+}
+
 func (s *Stat) Mtime() int64 {
 	return s.mtime
 }